@@ -2,21 +2,118 @@ package caf
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 // CAFFileMetadata represents metadata for a file in the CAF archive
 type CAFFileMetadata struct {
-	StartByte int64 `json:"start_byte"`
-	EndByte   int64 `json:"end_byte"`
+	StartByte int64  `json:"start_byte"`
+	EndByte   int64  `json:"end_byte"`
+	SHA256    string `json:"sha256,omitempty"` // Hex-encoded checksum of the stored bytes, empty for legacy archives
+
+	Compression  string `json:"compression,omitempty"`   // Codec applied to the stored bytes, empty for none
+	OriginalSize int64  `json:"original_size,omitempty"` // Size before compression or encryption, absent in older archives
+
+	ModTime     *time.Time `json:"mod_time,omitempty"`     // Source file modification time, nil when unknown
+	Mode        uint32     `json:"mode,omitempty"`         // Source file permission bits, 0 when unknown
+	ContentType string     `json:"content_type,omitempty"` // MIME type detected when added from disk, empty when unknown
+
+	Encrypted bool   `json:"encrypted,omitempty"` // Stored bytes are AES-GCM encrypted
+	Nonce     string `json:"nonce,omitempty"`     // Hex-encoded AES-GCM nonce, set when Encrypted
+}
+
+// StoredSize returns the number of bytes the file occupies in the archive
+func (m CAFFileMetadata) StoredSize() int64 {
+	return m.EndByte - m.StartByte
+}
+
+// Size returns the file's logical size, i.e. the number of bytes extraction
+// yields. Plain entries from older archives fall back to the stored size.
+func (m CAFFileMetadata) Size() int64 {
+	if m.OriginalSize > 0 || m.Compression != CompressionNone || m.Encrypted {
+		return m.OriginalSize
+	}
+	return m.StoredSize()
+}
+
+// Supported values for CAFFileMetadata.Compression
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+)
+
+// Every CAF archive starts with a magic signature followed by a one-byte header
+// version, which also decides how the index is encoded and located
+const (
+	cafMagic                 = "CAF1"
+	headerVersionPlainIndex  = byte(1) // Index stored as raw JSON
+	headerVersion            = byte(2) // Index stored as gzip-compressed JSON; written by current writers
+	headerVersionIndexOffset = byte(3) // Gzip-compressed index located by the header rather than a footer
+	headerSize               = int64(len(cafMagic) + 1)
+	indexHeaderSize          = headerSize + 16 // Version 3 header, which adds the index offset and size
+)
+
+// newHeader returns the header written by the given version. The index offset
+// and size of a version 3 header are left zero until Finalize fills them in.
+func newHeader(version byte) []byte {
+	header := make([]byte, dataOffset(version))
+	copy(header, cafMagic)
+	header[len(cafMagic)] = version
+	return header
+}
+
+// dataOffset returns where file data starts in archives with the given header version
+func dataOffset(version byte) int64 {
+	switch version {
+	case 0:
+		return 0 // Legacy archive without a header
+	case headerVersionIndexOffset:
+		return indexHeaderSize
+	default:
+		return headerSize
+	}
+}
+
+// indexCompressed reports whether archives with the given header version gzip the index
+func indexCompressed(version byte) bool {
+	return version == headerVersion || version == headerVersionIndexOffset
 }
 
+// footerSize is the length of the trailing index size field
+const footerSize = 4
+
+// ErrNotCAFArchive is returned when a file does not start with the CAF magic header
+var ErrNotCAFArchive = errors.New("not a CAF archive")
+
+// ErrDuplicatePath is returned when adding a path the archive already holds,
+// unless overwriting is enabled
+var ErrDuplicatePath = errors.New("path already exists in archive")
+
+// compressionRatioThreshold is the compressed/original size ratio above which
+// AddFileCompressed stores a file raw, since compressing it gains too little
+const compressionRatioThreshold = 0.9
+
 // CAFIndex represents the index structure of a CAF archive
 type CAFIndex struct {
 	FormatVersion string                     `json:"format_version"`
@@ -26,52 +123,431 @@ type CAFIndex struct {
 // CAFSerializer creates CAF archive files
 type CAFSerializer struct {
 	outputPath   string
-	file         *os.File
+	writePath    string // File being written; renamed to outputPath by Finalize
+	finalized    bool
+	file         *os.File  // nil when writing to a caller-supplied io.Writer
+	dest         io.Writer // Where writer flushes to: file or the caller's io.Writer
 	writer       *bufio.Writer
 	currentPos   int64
 	fileIndex    map[string]CAFFileMetadata
 	maxChunkSize int64
-	tempFile     bool
+	tempFile     bool // outputPath was generated because the caller passed none
+	logger       *slog.Logger
+	contentIndex map[string]CAFFileMetadata // Stored content key -> first entry, nil unless deduplicating
+	version      byte                       // Header version, which decides how Finalize encodes the index
+	aead         cipher.AEAD                // Encrypts file contents, nil unless encrypting
+	progress     ProgressFunc
+	spill        *indexSpill // Holds the index entries instead of fileIndex, nil unless spilling
+	overwrite    bool        // Adding an existing path replaces its entry instead of failing
+	trailer      []byte      // Original index and footer of an appended archive, restored by Cleanup
+	trailerStart int64       // Offset trailer was read from
 }
 
 // NewCAFSerializer creates a new CAF serializer
 func NewCAFSerializer(outputPath string, maxChunkSizeGB int) (*CAFSerializer, error) {
-	if outputPath == "" {
-		tempFile, err := createTempFile()
+	tempFile := outputPath == ""
+
+	var (
+		file *os.File
+		err  error
+	)
+	if tempFile {
+		// Nobody else owns a generated path, so write to it directly
+		file, err = createTempFile()
 		if err != nil {
 			return nil, fmt.Errorf("failed to create temp file: %w", err)
 		}
-		outputPath = tempFile
-	}
-
-	file, err := os.Create(outputPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create output file: %w", err)
+		outputPath = file.Name()
+	} else {
+		// Write next to the destination and rename into place on Finalize, so an
+		// interrupted run never leaves a half-written archive under outputPath
+		file, err = os.CreateTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".*.tmp")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create output file: %w", err)
+		}
 	}
+	writePath := file.Name()
 
 	writer := bufio.NewWriter(file)
 	maxChunkSize := int64(maxChunkSizeGB) * 1024 * 1024 * 1024
 
+	// Write the magic header so the archive is identifiable
+	if _, err := writer.Write(newHeader(headerVersion)); err != nil {
+		_ = file.Close()
+		_ = os.Remove(writePath)
+		return nil, fmt.Errorf("failed to write header: %w", err)
+	}
+
 	return &CAFSerializer{
 		outputPath:   outputPath,
+		writePath:    writePath,
 		file:         file,
+		dest:         file,
 		writer:       writer,
-		currentPos:   0,
+		currentPos:   headerSize,
 		fileIndex:    make(map[string]CAFFileMetadata),
 		maxChunkSize: maxChunkSize,
-		tempFile:     outputPath != "",
+		tempFile:     tempFile,
+		logger:       discardLogger,
+		version:      headerVersion,
+	}, nil
+}
+
+// NewCAFSerializerToWriter creates a CAF serializer that streams the archive to w
+// instead of a file, e.g. the body of an upload. The format is append-only, so w
+// need not support seeking. Finalize flushes the index and footer to w, returns
+// an empty path and leaves closing w to the caller.
+func NewCAFSerializerToWriter(w io.Writer, maxChunkSizeGB int) (*CAFSerializer, error) {
+	writer := bufio.NewWriter(w)
+
+	// Write the magic header so the archive is identifiable
+	if _, err := writer.Write(newHeader(headerVersion)); err != nil {
+		return nil, fmt.Errorf("failed to write header: %w", err)
+	}
+
+	return &CAFSerializer{
+		dest:         w,
+		writer:       writer,
+		currentPos:   headerSize,
+		fileIndex:    make(map[string]CAFFileMetadata),
+		maxChunkSize: int64(maxChunkSizeGB) * 1024 * 1024 * 1024,
+		logger:       discardLogger,
+		version:      headerVersion,
+	}, nil
+}
+
+// discardLogger is the default serializer logger, which drops every record
+var discardLogger = slog.New(discardHandler{})
+
+// discardHandler is a slog.Handler that ignores all log records
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// SetLogger sets the logger used for diagnostic messages. Messages are logged at
+// debug level; passing nil silences them again.
+func (s *CAFSerializer) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = discardLogger
+	}
+	s.logger = logger
+}
+
+// SetProgress sets a callback that is told how much of each added file has been
+// written. Streamed files report after every chunk; nil disables reporting.
+func (s *CAFSerializer) SetProgress(progress ProgressFunc) {
+	s.progress = progress
+}
+
+// reportProgress passes a progress update to the callback, if any
+func (s *CAFSerializer) reportProgress(filePath string, bytesDone, bytesTotal int64) {
+	if s.progress != nil {
+		s.progress(filePath, bytesDone, bytesTotal)
+	}
+}
+
+// SetCompressIndex chooses whether Finalize gzips the index, which is the default.
+// A plain JSON index keeps the archive readable by older CAF readers. The choice
+// is recorded in the header, so it must be made before any file is added and is
+// not possible when appending.
+func (s *CAFSerializer) SetCompressIndex(enabled bool) error {
+	if !s.headerOnly() {
+		return fmt.Errorf("index compression must be chosen before any file is added")
+	}
+	if s.version == headerVersionIndexOffset {
+		if enabled {
+			return nil
+		}
+		return fmt.Errorf("an index located by the header is always compressed")
+	}
+
+	version := headerVersionPlainIndex
+	if enabled {
+		version = headerVersion
+	}
+	return s.rewriteHeader(version)
+}
+
+// SetHeaderIndexOffset chooses whether Finalize records the index's offset and
+// size in the header instead of a footer, so readers (e.g. of a memory-mapped
+// archive) can locate the index with a single read of a fixed-size header.
+// Finalize seeks back to fill in the header, so this needs a serializer that
+// writes to a file. The index is always gzipped. Like SetCompressIndex, it must
+// be called before any file is added.
+func (s *CAFSerializer) SetHeaderIndexOffset(enabled bool) error {
+	if !s.headerOnly() {
+		return fmt.Errorf("the index location must be chosen before any file is added")
+	}
+	if enabled == (s.version == headerVersionIndexOffset) {
+		return nil
+	}
+	if !enabled {
+		return s.rewriteHeader(headerVersion)
+	}
+	if s.file == nil {
+		return fmt.Errorf("recording the index offset in the header requires writing to a file")
+	}
+	return s.rewriteHeader(headerVersionIndexOffset)
+}
+
+// headerOnly reports whether nothing but the header has been written, and the
+// header is still buffered
+func (s *CAFSerializer) headerOnly() bool {
+	size := dataOffset(s.version)
+	return s.currentPos == size && s.writer.Buffered() == int(size)
+}
+
+// rewriteHeader replaces the buffered header with one for the given version
+func (s *CAFSerializer) rewriteHeader(version byte) error {
+	header := newHeader(version)
+	s.writer.Reset(s.dest)
+	if _, err := s.writer.Write(header); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	s.version = version
+	s.currentPos = int64(len(header))
+	return nil
+}
+
+// SetOverwrite chooses whether adding a path that is already in the archive
+// replaces its entry rather than failing with ErrDuplicatePath, the default. The
+// replaced entry's bytes stay in the archive, unreferenced.
+func (s *CAFSerializer) SetOverwrite(enabled bool) {
+	s.overwrite = enabled
+}
+
+// checkPath returns ErrDuplicatePath if filePath is already indexed and
+// overwriting is disabled
+func (s *CAFSerializer) checkPath(filePath string) error {
+	if !s.overwrite && s.hasEntry(filePath) {
+		return fmt.Errorf("%w: '%s'", ErrDuplicatePath, filePath)
+	}
+	return nil
+}
+
+// SetDeduplicate enables or disables content deduplication. When enabled, a file
+// whose content matches an already-written file is indexed against the existing
+// byte range instead of being written again. Deduplication requires hashing every
+// file up front and is disabled by default.
+func (s *CAFSerializer) SetDeduplicate(enabled bool) {
+	if !enabled {
+		s.contentIndex = nil
+		return
+	}
+
+	// Seed with entries already in the index, e.g. when appending
+	s.contentIndex = make(map[string]CAFFileMetadata, s.fileCount())
+	_ = s.eachEntry(func(_ string, metadata CAFFileMetadata) error {
+		if metadata.SHA256 != "" {
+			key := contentKey(metadata.Compression, metadata.SHA256)
+			if _, exists := s.contentIndex[key]; !exists {
+				s.contentIndex[key] = metadata
+			}
+		}
+		return nil
+	})
+}
+
+// contentKey identifies stored content for deduplication; the codec is part of
+// the key so identical stored bytes with different codecs are never shared
+func contentKey(compression, checksum string) string {
+	return compression + ":" + checksum
+}
+
+// addDuplicate indexes filePath against previously written content with the
+// same key, reporting whether such content exists
+func (s *CAFSerializer) addDuplicate(filePath, compression, checksum string) bool {
+	if s.contentIndex == nil || s.aead != nil {
+		return false
+	}
+
+	existing, exists := s.contentIndex[contentKey(compression, checksum)]
+	if !exists {
+		return false
+	}
+
+	s.indexEntry(filePath, CAFFileMetadata{
+		StartByte:    existing.StartByte,
+		EndByte:      existing.EndByte,
+		SHA256:       existing.SHA256,
+		Compression:  existing.Compression,
+		OriginalSize: existing.OriginalSize,
+	})
+	s.logger.Debug("CAF: deduplicated file", "path", filePath, "start_byte", existing.StartByte, "end_byte", existing.EndByte)
+	return true
+}
+
+// recordContent remembers an entry's content for later deduplication
+func (s *CAFSerializer) recordContent(metadata CAFFileMetadata) {
+	if s.contentIndex == nil {
+		return
+	}
+
+	key := contentKey(metadata.Compression, metadata.SHA256)
+	if _, exists := s.contentIndex[key]; !exists {
+		s.contentIndex[key] = metadata
+	}
+}
+
+// NewCAFAppender opens an existing finalized CAF archive so more files can be added.
+// New files are written over the old index and footer, which Finalize replaces
+// with an index merged with the new entries. Until then the old index is kept in
+// memory, and Cleanup puts it back, so an appender that is never finalized leaves
+// the archive as it was. Adding a path that already exists is an error unless
+// SetOverwrite(true) is called.
+func NewCAFAppender(archivePath string, maxChunkSizeGB int) (*CAFSerializer, error) {
+	deserializer := NewCAFDeserializer(archivePath)
+	defer func() { _ = deserializer.Close() }()
+	if err := deserializer.LoadIndex(); err != nil {
+		return nil, fmt.Errorf("failed to load existing archive: %w", err)
+	}
+
+	if deserializer.index.FormatVersion != "1.0" {
+		return nil, fmt.Errorf("unsupported format version '%s'", deserializer.index.FormatVersion)
+	}
+
+	file, err := os.OpenFile(archivePath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive file: %w", err)
+	}
+
+	// Keep the old index and footer so Cleanup can restore them
+	fileInfo, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to stat archive file: %w", err)
+	}
+	trailer := make([]byte, fileInfo.Size()-deserializer.indexStart)
+	if _, err := file.ReadAt(trailer, deserializer.indexStart); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to read archive index: %w", err)
+	}
+
+	// Continue writing where the data ended
+	if _, err := file.Seek(deserializer.indexStart, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to seek archive: %w", err)
+	}
+
+	fileIndex := make(map[string]CAFFileMetadata, len(deserializer.index.Files))
+	for filePath, metadata := range deserializer.index.Files {
+		fileIndex[filePath] = metadata
+	}
+
+	// The header stays as it is, so the index keeps the encoding it already had
+	return &CAFSerializer{
+		outputPath:   archivePath,
+		writePath:    archivePath,
+		file:         file,
+		dest:         file,
+		writer:       bufio.NewWriter(file),
+		currentPos:   deserializer.indexStart,
+		fileIndex:    fileIndex,
+		maxChunkSize: int64(maxChunkSizeGB) * 1024 * 1024 * 1024,
+		logger:       discardLogger,
+		version:      deserializer.version,
+		trailer:      trailer,
+		trailerStart: deserializer.indexStart,
 	}, nil
 }
 
-// createTempFile creates a temporary file for the CAF archive
-func createTempFile() (string, error) {
-	tempDir := os.TempDir()
-	fileName := fmt.Sprintf("caf_%d_%d.caf", time.Now().UnixNano(), os.Getpid())
-	return filepath.Join(tempDir, fileName), nil
+// createTempFile creates a uniquely named temporary file for the CAF archive
+func createTempFile() (*os.File, error) {
+	return os.CreateTemp(os.TempDir(), fmt.Sprintf("caf_%d_*.caf", os.Getpid()))
 }
 
 // AddFile adds a file to the CAF archive
 func (s *CAFSerializer) AddFile(filePath string, data []byte) (bool, error) {
+	added, err := s.addData(filePath, data, CAFFileMetadata{})
+	if added {
+		s.reportProgress(filePath, int64(len(data)), int64(len(data)))
+	}
+	return added, err
+}
+
+// AddFileCompressed gzips a file before adding it to the CAF archive. Files that
+// barely shrink (e.g. already-compressed media) are stored raw instead.
+func (s *CAFSerializer) AddFileCompressed(filePath string, data []byte) (bool, error) {
+	stored, metadata, err := compressData(data)
+	if err != nil {
+		return false, err
+	}
+
+	added, err := s.addData(filePath, stored, metadata)
+	if added {
+		s.reportProgress(filePath, int64(len(data)), int64(len(data)))
+	}
+	return added, err
+}
+
+// compressData gzips data, returning the bytes to store and the codec fields of
+// their index entry. Data that barely shrinks is returned unchanged.
+func compressData(data []byte) ([]byte, CAFFileMetadata, error) {
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	if _, err := gzipWriter.Write(data); err != nil {
+		return nil, CAFFileMetadata{}, fmt.Errorf("failed to compress file data: %w", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, CAFFileMetadata{}, fmt.Errorf("failed to compress file data: %w", err)
+	}
+
+	if float64(compressed.Len()) > float64(len(data))*compressionRatioThreshold {
+		return data, CAFFileMetadata{}, nil
+	}
+	return compressed.Bytes(), CAFFileMetadata{
+		Compression:  CompressionGzip,
+		OriginalSize: int64(len(data)),
+	}, nil
+}
+
+// addData writes data to the archive and indexes it, filling in the byte range
+// and checksum of metadata. Data is encrypted first when encrypting.
+func (s *CAFSerializer) addData(filePath string, data []byte, metadata CAFFileMetadata) (bool, error) {
+	data, metadata, err := s.sealData(data, metadata)
+	if err != nil {
+		return false, err
+	}
+	return s.writeSealed(filePath, data, metadata)
+}
+
+// sealData encrypts data when encrypting and checksums the result, returning the
+// bytes to store and their index entry without a byte range. It does not touch
+// the archive, so it is safe to call from several goroutines.
+func (s *CAFSerializer) sealData(data []byte, metadata CAFFileMetadata) ([]byte, CAFFileMetadata, error) {
+	if metadata.Compression == CompressionNone {
+		metadata.OriginalSize = int64(len(data))
+	}
+
+	if s.aead != nil {
+		sealed, nonce, err := s.seal(data)
+		if err != nil {
+			return nil, CAFFileMetadata{}, err
+		}
+		data = sealed
+		metadata.Encrypted = true
+		metadata.Nonce = nonce
+	}
+
+	checksum := sha256.Sum256(data)
+	metadata.SHA256 = hex.EncodeToString(checksum[:])
+	return data, metadata, nil
+}
+
+// writeSealed writes bytes prepared by sealData to the archive and indexes them
+func (s *CAFSerializer) writeSealed(filePath string, data []byte, metadata CAFFileMetadata) (bool, error) {
+	if err := s.checkPath(filePath); err != nil {
+		return false, err
+	}
+
+	// Identical content costs no space, so check before the size limit
+	if s.addDuplicate(filePath, metadata.Compression, metadata.SHA256) {
+		return true, nil
+	}
+
 	// Check if adding this file would exceed the chunk size limit
 	if s.currentPos+int64(len(data)) > s.maxChunkSize {
 		return false, nil
@@ -92,10 +568,10 @@ func (s *CAFSerializer) AddFile(filePath string, data []byte) (bool, error) {
 	endByte := s.currentPos + int64(len(data))
 
 	// Add to index
-	s.fileIndex[filePath] = CAFFileMetadata{
-		StartByte: startByte,
-		EndByte:   endByte,
-	}
+	metadata.StartByte = startByte
+	metadata.EndByte = endByte
+	s.indexEntry(filePath, metadata)
+	s.recordContent(metadata)
 
 	s.currentPos = endByte
 	return true, nil
@@ -103,316 +579,1209 @@ func (s *CAFSerializer) AddFile(filePath string, data []byte) (bool, error) {
 
 // AddFileFromReader adds a file to the CAF archive from a reader
 func (s *CAFSerializer) AddFileFromReader(filePath string, reader io.Reader, contentLength int64) (bool, error) {
-	fmt.Printf("CAF: Starting to add file stream: %s (%d bytes)\n", filePath, contentLength)
-	fmt.Printf("CAF: Current position: %d, Max size: %d\n", s.currentPos, s.maxChunkSize)
+	return s.AddFileFromReaderContext(context.Background(), filePath, reader, contentLength)
+}
+
+// AddFileFromReaderContext adds a file to the CAF archive from a reader, aborting
+// the copy with ctx.Err() once ctx is cancelled. A cancelled serializer holds a
+// partially written file and should be discarded.
+func (s *CAFSerializer) AddFileFromReaderContext(ctx context.Context, filePath string, reader io.Reader, contentLength int64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if err := s.checkPath(filePath); err != nil {
+		return false, err
+	}
+
+	// Encryption seals each file as a whole, so the stream is buffered in memory
+	if s.aead != nil {
+		if s.currentPos+contentLength+int64(s.aead.Overhead()) > s.maxChunkSize {
+			return false, nil
+		}
+
+		tracked := newProgressReader(&contextReader{ctx: ctx, reader: reader}, s.progress, filePath, contentLength)
+		data, err := io.ReadAll(io.LimitReader(tracked, contentLength+1))
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return false, ctxErr
+			}
+			return false, fmt.Errorf("failed to read data from reader: %w", err)
+		}
+		if int64(len(data)) != contentLength {
+			return false, fmt.Errorf("size mismatch: read %d bytes, expected %d", len(data), contentLength)
+		}
+		return s.addData(filePath, data, CAFFileMetadata{})
+	}
+
+	// Deduplicating a stream requires hashing it before writing, which is only
+	// possible when the reader can be rewound
+	if seeker, ok := reader.(io.ReadSeeker); ok && s.contentIndex != nil {
+		checksum, err := hashStream(ctx, seeker, contentLength)
+		if err != nil {
+			return false, err
+		}
+		if s.addDuplicate(filePath, CompressionNone, checksum) {
+			s.reportProgress(filePath, contentLength, contentLength)
+			return true, nil
+		}
+	}
+
+	s.logger.Debug("CAF: starting to add file stream", "path", filePath, "bytes", contentLength,
+		"position", s.currentPos, "max_size", s.maxChunkSize)
 
 	// Check if adding this file would exceed the chunk size limit
 	if s.currentPos+contentLength > s.maxChunkSize {
-		fmt.Printf("CAF: File %s would exceed size limit (%d > %d)\n", filePath, s.currentPos+contentLength, s.maxChunkSize)
+		s.logger.Debug("CAF: file would exceed size limit", "path", filePath,
+			"size", s.currentPos+contentLength, "max_size", s.maxChunkSize)
 		return false, nil
 	}
 
 	startByte := s.currentPos
-	fmt.Printf("CAF: Adding file %s at position %d\n", filePath, startByte)
 
 	startTime := time.Now()
 
-	// Copy data from reader to writer
-	written, err := io.Copy(s.writer, reader)
+	// Copy data from reader to writer, hashing it on the way through
+	hasher := sha256.New()
+	tracked := newProgressReader(&contextReader{ctx: ctx, reader: reader}, s.progress, filePath, contentLength)
+	written, err := io.Copy(io.MultiWriter(s.writer, hasher), tracked)
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return false, ctxErr
+		}
 		return false, fmt.Errorf("failed to copy data from reader: %w", err)
 	}
 
-	if written != contentLength {
-		return false, fmt.Errorf("size mismatch: wrote %d bytes, expected %d", written, contentLength)
+	if written != contentLength {
+		return false, fmt.Errorf("size mismatch: wrote %d bytes, expected %d", written, contentLength)
+	}
+
+	endByte := s.currentPos + contentLength
+	duration := time.Since(startTime)
+	throughput := float64(contentLength) / 1024 / 1024 / duration.Seconds() // MB/s
+
+	s.logger.Debug("CAF: finished streaming file", "path", filePath, "duration", duration,
+		"mb_per_sec", fmt.Sprintf("%.2f", throughput), "start_byte", startByte, "end_byte", endByte)
+
+	// Add to index
+	metadata := CAFFileMetadata{
+		StartByte:    startByte,
+		EndByte:      endByte,
+		SHA256:       hex.EncodeToString(hasher.Sum(nil)),
+		OriginalSize: contentLength,
+	}
+	s.indexEntry(filePath, metadata)
+	s.recordContent(metadata)
+
+	s.currentPos = endByte
+	return true, nil
+}
+
+// hashStream computes the hex SHA-256 of the next length bytes of a seekable
+// stream, then rewinds it. A stream that is shorter or longer than length is a
+// size mismatch, as it is when the stream is copied.
+func hashStream(ctx context.Context, stream io.ReadSeeker, length int64) (string, error) {
+	start, err := stream.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", fmt.Errorf("failed to seek reader: %w", err)
+	}
+
+	hasher := sha256.New()
+	read, err := io.CopyN(hasher, &contextReader{ctx: ctx, reader: stream}, length)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+		if errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("size mismatch: read %d bytes, expected %d", read, length)
+		}
+		return "", fmt.Errorf("failed to hash reader: %w", err)
+	}
+	if _, err := io.ReadFull(stream, make([]byte, 1)); err == nil {
+		return "", fmt.Errorf("size mismatch: reader holds more than %d bytes", length)
+	}
+
+	if _, err := stream.Seek(start, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to rewind reader: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// contextReader wraps a reader so that reads fail once its context is cancelled
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// ProgressFunc receives progress updates while a file is added or extracted:
+// bytesDone of the file's bytesTotal bytes have been processed. It is called
+// from the goroutine doing the work, so with concurrent extraction it must be
+// safe for concurrent use.
+type ProgressFunc func(filePath string, bytesDone, bytesTotal int64)
+
+// progressReader reports the bytes read through it to a ProgressFunc
+type progressReader struct {
+	reader   io.Reader
+	progress ProgressFunc
+	filePath string
+	done     int64
+	total    int64
+}
+
+// newProgressReader wraps reader so every read is reported, announcing the file
+// with an initial zero-byte update. Without a callback reader is returned as is.
+func newProgressReader(reader io.Reader, progress ProgressFunc, filePath string, total int64) io.Reader {
+	if progress == nil {
+		return reader
+	}
+	progress(filePath, 0, total)
+	return &progressReader{reader: reader, progress: progress, filePath: filePath, total: total}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.done += int64(n)
+		r.progress(r.filePath, r.done, r.total)
+	}
+	return n, err
+}
+
+// progressWriter reports the bytes written through it to a ProgressFunc
+type progressWriter struct {
+	writer   io.Writer
+	progress ProgressFunc
+	filePath string
+	done     int64
+	total    int64
+}
+
+// newProgressWriter wraps writer so every write is reported, announcing the file
+// with an initial zero-byte update. Without a callback writer is returned as is.
+func newProgressWriter(writer io.Writer, progress ProgressFunc, filePath string, total int64) io.Writer {
+	if progress == nil {
+		return writer
+	}
+	progress(filePath, 0, total)
+	return &progressWriter{writer: writer, progress: progress, filePath: filePath, total: total}
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	if n > 0 {
+		w.done += int64(n)
+		w.progress(w.filePath, w.done, w.total)
+	}
+	return n, err
+}
+
+// AddFileFromPath adds a file from filesystem to the CAF archive
+func (s *CAFSerializer) AddFileFromPath(filePath string, sourceFilePath string) (bool, error) {
+	return s.AddFileFromPathContext(context.Background(), filePath, sourceFilePath)
+}
+
+// AddFileFromPathContext adds a file from filesystem to the CAF archive, aborting once ctx is cancelled
+func (s *CAFSerializer) AddFileFromPathContext(ctx context.Context, filePath string, sourceFilePath string) (bool, error) {
+	file, err := os.Open(sourceFilePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat source file: %w", err)
+	}
+
+	// The size limit is checked by AddFileFromReaderContext after looking for a
+	// duplicate, the same order as every other add, so a duplicate always fits
+	if err := s.checkPath(filePath); err != nil {
+		return false, err
+	}
+
+	// Sniff the content type from the leading bytes without moving the read offset
+	head := make([]byte, sniffLen)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("failed to read source file: %w", err)
+	}
+	contentType := detectContentType(filePath, head[:n])
+
+	added, err := s.AddFileFromReaderContext(ctx, filePath, file, fileInfo.Size())
+	if added {
+		s.recordFileInfo(filePath, fileInfo, contentType)
+	}
+	return added, err
+}
+
+// AddFileCompressedFromPath reads a file from the filesystem and adds it gzipped to the CAF archive
+func (s *CAFSerializer) AddFileCompressedFromPath(filePath string, sourceFilePath string) (bool, error) {
+	if err := s.checkPath(filePath); err != nil {
+		return false, err
+	}
+
+	fileInfo, err := os.Stat(sourceFilePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat source file: %w", err)
+	}
+
+	data, err := os.ReadFile(sourceFilePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read source file: %w", err)
+	}
+
+	added, err := s.AddFileCompressed(filePath, data)
+	if added {
+		s.recordFileInfo(filePath, fileInfo, detectContentType(filePath, data))
+	}
+	return added, err
+}
+
+// recordFileInfo stores the source file's modification time, permissions and
+// content type in its index entry
+func (s *CAFSerializer) recordFileInfo(filePath string, fileInfo os.FileInfo, contentType string) {
+	metadata, _ := s.lookupEntry(filePath)
+	modTime := fileInfo.ModTime()
+	metadata.ModTime = &modTime
+	metadata.Mode = uint32(fileInfo.Mode().Perm())
+	metadata.ContentType = contentType
+	s.indexEntry(filePath, metadata)
+}
+
+// sniffLen is the number of leading bytes http.DetectContentType considers
+const sniffLen = 512
+
+// detectContentType returns the MIME type registered for the archive path's
+// extension, falling back to sniffing the file's leading bytes. An empty file
+// without a known extension has no type.
+func detectContentType(filePath string, data []byte) string {
+	if contentType := mime.TypeByExtension(path.Ext(filePath)); contentType != "" {
+		return contentType
+	}
+	if len(data) == 0 {
+		return ""
+	}
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	return http.DetectContentType(data)
+}
+
+// Cleanup frees resources used by the serializer. If Finalize was never reached,
+// the partially written archive is removed, including auto-created temp archives.
+func (s *CAFSerializer) Cleanup() error {
+	var err error
+	if s.writer != nil {
+		err = s.writer.Flush()
+		s.writer = nil
+	}
+	if !s.finalized && s.trailer != nil && s.file != nil {
+		// Drop whatever was appended and put the original index back
+		if restoreErr := s.restoreTrailer(); restoreErr != nil {
+			err = restoreErr
+		}
+	}
+	if s.file != nil {
+		if closeErr := s.file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		s.file = nil
+	}
+	if !s.finalized && (s.tempFile || s.writePath != s.outputPath) {
+		if removeErr := os.Remove(s.writePath); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = removeErr
+		}
+	}
+	if s.spill != nil {
+		if closeErr := s.spill.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		s.spill = nil
+	}
+	// Clear the file index to free memory
+	s.fileIndex = make(map[string]CAFFileMetadata)
+	return err
+}
+
+// restoreTrailer returns an appended archive to its original state by cutting
+// off the new data and writing the original index and footer back after the old data
+func (s *CAFSerializer) restoreTrailer() error {
+	if err := s.file.Truncate(s.trailerStart); err != nil {
+		return fmt.Errorf("failed to restore archive index: %w", err)
+	}
+	if _, err := s.file.WriteAt(s.trailer, s.trailerStart); err != nil {
+		return fmt.Errorf("failed to restore archive index: %w", err)
+	}
+	return nil
+}
+
+// Finalize completes the CAF archive by writing the index and footer
+func (s *CAFSerializer) Finalize() (string, error) {
+	s.logger.Debug("CAF: starting finalization", "path", s.outputPath, "data_bytes", s.currentPos, "files", s.fileCount())
+
+	indexSize, err := s.writeIndex()
+	if err != nil {
+		return "", err
+	}
+	s.logger.Debug("CAF: index written", "bytes", indexSize)
+
+	// Archives that locate the index from the header have no footer
+	trailerSize := int64(0)
+	if s.version != headerVersionIndexOffset {
+		if indexSize > math.MaxUint32 {
+			return "", fmt.Errorf("index is too large: %d bytes", indexSize)
+		}
+
+		// Write footer (index size as 4-byte little-endian uint32)
+		footerBuffer := make([]byte, 4)
+		binary.LittleEndian.PutUint32(footerBuffer, uint32(indexSize))
+
+		n, err := s.writer.Write(footerBuffer)
+		if err != nil {
+			return "", fmt.Errorf("failed to write footer: %w", err)
+		}
+		if n != 4 {
+			return "", fmt.Errorf("incomplete footer write: wrote %d bytes, expected 4", n)
+		}
+		trailerSize = footerSize
+	}
+
+	// Flush and close
+	if err := s.writer.Flush(); err != nil {
+		return "", fmt.Errorf("failed to flush writer: %w", err)
+	}
+
+	// An appended archive may end before the original index and footer did
+	if s.trailer != nil {
+		if err := s.file.Truncate(s.currentPos + indexSize + trailerSize); err != nil {
+			return "", fmt.Errorf("failed to truncate archive: %w", err)
+		}
+	}
+
+	if s.version == headerVersionIndexOffset {
+		if _, err := s.file.WriteAt(indexLocation(s.currentPos, indexSize), headerSize); err != nil {
+			return "", fmt.Errorf("failed to write header: %w", err)
+		}
+	}
+
+	if s.spill != nil {
+		if err := s.spill.close(); err != nil {
+			return "", fmt.Errorf("failed to remove index spill file: %w", err)
+		}
+		s.spill = nil
+	}
+
+	// Writer-backed archives are complete once flushed
+	if s.file == nil {
+		s.finalized = true
+		s.writer = nil
+		s.logger.Debug("CAF: finalized streamed archive", "bytes", s.currentPos+indexSize+trailerSize)
+		return "", nil
+	}
+
+	if err := s.file.Close(); err != nil {
+		return "", fmt.Errorf("failed to close file: %w", err)
+	}
+
+	// Move the finished archive into place
+	if s.writePath != s.outputPath {
+		if err := os.Chmod(s.writePath, 0o644); err != nil {
+			return "", fmt.Errorf("failed to set archive permissions: %w", err)
+		}
+		if err := os.Rename(s.writePath, s.outputPath); err != nil {
+			return "", fmt.Errorf("failed to move archive into place: %w", err)
+		}
+	}
+	s.finalized = true
+
+	finalSize := s.currentPos + indexSize + trailerSize
+	s.logger.Debug("CAF: finalized archive", "path", s.outputPath, "bytes", finalSize)
+
+	// Clear resources
+	s.writer = nil
+	s.file = nil
+
+	return s.outputPath, nil
+}
+
+// indexLocation encodes the index offset and size fields of a version 3 header
+func indexLocation(indexStart, indexSize int64) []byte {
+	location := binary.LittleEndian.AppendUint64(nil, uint64(indexStart))
+	return binary.LittleEndian.AppendUint64(location, uint64(indexSize))
+}
+
+// writeIndex writes the index to the archive, returning its size in bytes
+func (s *CAFSerializer) writeIndex() (int64, error) {
+	if s.spill != nil {
+		return s.writeSpilledIndex()
+	}
+
+	index := CAFIndex{
+		FormatVersion: "1.0",
+		Files:         s.fileIndex,
+	}
+
+	indexData, err := encodeIndex(index, s.version)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := s.writer.Write(indexData)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write index: %w", err)
+	}
+	if n != len(indexData) {
+		return 0, fmt.Errorf("incomplete index write: wrote %d bytes, expected %d", n, len(indexData))
+	}
+	return int64(n), nil
+}
+
+// GetArchivePath returns the current archive file path
+func (s *CAFSerializer) GetArchivePath() string {
+	return s.outputPath
+}
+
+// GetCurrentSize returns the current size of the archive in bytes
+func (s *CAFSerializer) GetCurrentSize() int64 {
+	return s.currentPos
+}
+
+// GetFileList returns the list of files currently in the archive, sorted by path
+func (s *CAFSerializer) GetFileList() []string {
+	files := make([]string, 0, s.fileCount())
+	if s.spill != nil {
+		for filePath := range s.spill.latest {
+			files = append(files, filePath)
+		}
+	}
+	for filePath := range s.fileIndex {
+		files = append(files, filePath)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// GetMaxSize returns the current size limit in bytes
+func (s *CAFSerializer) GetMaxSize() int64 {
+	return s.maxChunkSize
+}
+
+// GetMaxSizeGB returns the current size limit in GB
+func (s *CAFSerializer) GetMaxSizeGB() float64 {
+	return float64(s.maxChunkSize) / (1024 * 1024 * 1024)
+}
+
+// ErrFileNotFound is returned when a requested path is not present in the archive index
+var ErrFileNotFound = errors.New("file not found in archive")
+
+// extractBufferSize is the read buffer size used when streaming files out of an archive
+const extractBufferSize = 1024 * 1024
+
+// CAFDeserializer reads files from CAF archive files
+type CAFDeserializer struct {
+	archivePath string
+	reader      io.ReaderAt
+	closer      io.Closer
+	index       *CAFIndex
+	fileSize    int64
+	version     byte // Header version, 0 for legacy archives without a header
+	dataStart   int64
+	indexStart  int64
+	indexEnd    int64 // End of the index; the footer, if any, follows it
+	allowLegacy bool
+	aead        cipher.AEAD // Decrypts encrypted files, nil until SetKey
+	progress    ProgressFunc
+}
+
+// NewCAFDeserializer creates a new CAF deserializer for an archive on disk. The
+// file is opened by LoadIndex and stays open until Close is called.
+func NewCAFDeserializer(archivePath string) *CAFDeserializer {
+	return &CAFDeserializer{
+		archivePath: archivePath,
+	}
+}
+
+// NewCAFDeserializerFromReaderAt creates a CAF deserializer that reads the archive
+// through r, e.g. an in-memory buffer or an HTTP range reader. size is the total
+// archive length in bytes.
+func NewCAFDeserializerFromReaderAt(r io.ReaderAt, size int64) *CAFDeserializer {
+	return &CAFDeserializer{
+		archivePath: "<reader>",
+		reader:      r,
+		fileSize:    size,
+	}
+}
+
+// Close releases the archive file opened by LoadIndex. Readers passed to
+// NewCAFDeserializerFromReaderAt are left for the caller to close.
+func (d *CAFDeserializer) Close() error {
+	if d.closer == nil {
+		return nil
+	}
+	err := d.closer.Close()
+	d.closer = nil
+	d.reader = nil
+	return err
+}
+
+// open opens the archive file for path-based deserializers
+func (d *CAFDeserializer) open() error {
+	if d.reader != nil {
+		return nil
+	}
+
+	file, err := os.Open(d.archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive file: %w", err)
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to stat archive file: %w", err)
+	}
+
+	d.reader = file
+	d.closer = file
+	d.fileSize = fileInfo.Size()
+	return nil
+}
+
+// readFullAt fills buf from r at off, tolerating io.EOF when buf is filled exactly
+// at the end of the archive as the io.ReaderAt contract allows
+func readFullAt(r io.ReaderAt, buf []byte, off int64) error {
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) && (err == nil || errors.Is(err, io.EOF)) {
+		return nil
+	}
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// SetAllowLegacy controls whether archives written before the magic header was
+// introduced can be loaded. It is disabled by default.
+func (d *CAFDeserializer) SetAllowLegacy(allow bool) {
+	d.allowLegacy = allow
+}
+
+// SetProgress sets a callback that is told how much of each file has been
+// extracted, after every chunk copied; nil disables reporting
+func (d *CAFDeserializer) SetProgress(progress ProgressFunc) {
+	d.progress = progress
+}
+
+// LoadIndex loads the CAF index for fast file lookups
+func (d *CAFDeserializer) LoadIndex() error {
+	if err := d.open(); err != nil {
+		return err
+	}
+
+	if d.fileSize < footerSize {
+		return fmt.Errorf("file too small to be a CAF archive: %d bytes", d.fileSize)
+	}
+
+	// Check the magic header, reading enough for the longest header in one go
+	header := make([]byte, min(indexHeaderSize, d.fileSize))
+	err := readFullAt(d.reader, header, 0)
+	hasMagic := err == nil && int64(len(header)) >= headerSize && string(header[:len(cafMagic)]) == cafMagic
+	if !hasMagic && !d.allowLegacy {
+		return fmt.Errorf("%w: '%s' is missing the CAF header", ErrNotCAFArchive, d.archivePath)
+	}
+	version := byte(0)
+	if hasMagic {
+		version = header[len(cafMagic)]
+		if version != headerVersionPlainIndex && version != headerVersion && version != headerVersionIndexOffset {
+			return fmt.Errorf("unsupported CAF header version %d", version)
+		}
+	}
+
+	dataStart := dataOffset(version)
+	var indexStart, indexSize int64
+	if version == headerVersionIndexOffset {
+		if int64(len(header)) < indexHeaderSize {
+			return fmt.Errorf("file too small to be a CAF archive: %d bytes", d.fileSize)
+		}
+
+		// The header says where the index is; make sure it lies within the archive
+		offset := binary.LittleEndian.Uint64(header[headerSize:])
+		size := binary.LittleEndian.Uint64(header[headerSize+8:])
+		if offset < uint64(dataStart) || offset > uint64(d.fileSize) || size > uint64(d.fileSize)-offset {
+			return fmt.Errorf("index location is outside the archive: %d bytes at offset %d, archive is %d bytes", size, offset, d.fileSize)
+		}
+		indexStart = int64(offset)
+		indexSize = int64(size)
+	} else {
+		// Read footer (last 4 bytes)
+		footerBuffer := make([]byte, footerSize)
+		if err := readFullAt(d.reader, footerBuffer, d.fileSize-footerSize); err != nil {
+			return fmt.Errorf("failed to read footer: %w", err)
+		}
+
+		indexSize = int64(binary.LittleEndian.Uint32(footerBuffer))
+
+		// Make sure the index fits between the header and the footer before allocating it
+		indexStart = d.fileSize - footerSize - indexSize
+		if indexStart < dataStart {
+			return fmt.Errorf("index size exceeds file length: index is %d bytes, archive is %d bytes", indexSize, d.fileSize)
+		}
+	}
+
+	// Read index
+	indexBuffer := make([]byte, indexSize)
+	if err := readFullAt(d.reader, indexBuffer, indexStart); err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+
+	index, err := decodeIndex(indexBuffer, version)
+	if err != nil {
+		return err
+	}
+
+	d.index = index
+	d.version = version
+	d.dataStart = dataStart
+	d.indexStart = indexStart
+	d.indexEnd = indexStart + indexSize
+	return nil
+}
+
+// encodeIndex serializes the index as JSON, gzipped for header versions that expect it
+func encodeIndex(index CAFIndex, version byte) ([]byte, error) {
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal index: %w", err)
+	}
+	if !indexCompressed(version) {
+		return indexJSON, nil
+	}
+
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	if _, err := gzipWriter.Write(indexJSON); err != nil {
+		return nil, fmt.Errorf("failed to compress index: %w", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress index: %w", err)
+	}
+	return compressed.Bytes(), nil
+}
+
+// decodeIndex parses an index stored with the given header version
+func decodeIndex(data []byte, version byte) (*CAFIndex, error) {
+	if indexCompressed(version) {
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open compressed index: %w", err)
+		}
+		defer func() { _ = gzipReader.Close() }()
+
+		data, err = io.ReadAll(gzipReader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress index: %w", err)
+		}
+	}
+
+	var index CAFIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse index: %w", err)
+	}
+	return &index, nil
+}
+
+// GetFileList returns all files in the archive, sorted by path
+func (d *CAFDeserializer) GetFileList() ([]string, error) {
+	if d.index == nil {
+		return nil, fmt.Errorf("index not loaded, call LoadIndex() first")
+	}
+
+	files := make([]string, 0, len(d.index.Files))
+	for filePath := range d.index.Files {
+		files = append(files, filePath)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// HasFile checks if a file exists in the archive
+func (d *CAFDeserializer) HasFile(filePath string) (bool, error) {
+	if d.index == nil {
+		return false, fmt.Errorf("index not loaded, call LoadIndex() first")
+	}
+	_, exists := d.index.Files[filePath]
+	return exists, nil
+}
+
+// ExtractFile extracts a specific file from the archive
+func (d *CAFDeserializer) ExtractFile(filePath string) ([]byte, error) {
+	if d.index == nil {
+		return nil, fmt.Errorf("index not loaded, call LoadIndex() first")
+	}
+
+	fileMetadata, exists := d.index.Files[filePath]
+	if !exists {
+		return nil, fmt.Errorf("%w: '%s'", ErrFileNotFound, filePath)
+	}
+
+	fileSize, err := d.storedLength(filePath, fileMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	// storedLength has checked the range lies in the data region, so an empty entry reads as empty
+	buffer := make([]byte, fileSize)
+	if fileSize > 0 {
+		if err := readFullAt(d.reader, buffer, fileMetadata.StartByte); err != nil {
+			return nil, fmt.Errorf("failed to read file data: %w", err)
+		}
+	}
+
+	if fileMetadata.Encrypted {
+		plaintext, err := d.decrypt(filePath, fileMetadata, buffer)
+		if err != nil {
+			return nil, err
+		}
+		buffer = plaintext
+	}
+
+	if fileMetadata.Compression == CompressionNone {
+		return buffer, nil
+	}
+
+	decoder, err := newDecompressor(fileMetadata.Compression, bytes.NewReader(buffer))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = decoder.Close() }()
+
+	data, err := io.ReadAll(decoder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress file data: %w", err)
+	}
+
+	return data, nil
+}
+
+// storedLength returns the length of an entry's stored byte range, which is zero
+// for empty files, rejecting ranges that end before they start or lie outside
+// the data between the header and the index
+func (d *CAFDeserializer) storedLength(filePath string, metadata CAFFileMetadata) (int64, error) {
+	if metadata.EndByte < metadata.StartByte {
+		return 0, fmt.Errorf("file '%s' has an invalid byte range [%d, %d)", filePath, metadata.StartByte, metadata.EndByte)
+	}
+	if metadata.StartByte < d.dataStart || metadata.EndByte > d.indexStart {
+		return 0, fmt.Errorf("file '%s' has byte range [%d, %d) outside the archive data [%d, %d)",
+			filePath, metadata.StartByte, metadata.EndByte, d.dataStart, d.indexStart)
+	}
+	return metadata.EndByte - metadata.StartByte, nil
+}
+
+// newDecompressor wraps r with a reader that decodes the given compression codec
+func newDecompressor(compression string, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		return gzipReader, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression '%s'", compression)
+	}
+}
+
+// ExtractFileToWriter streams a file from the archive into w without buffering it in memory,
+// decompressing it if needed. It returns the number of bytes copied.
+func (d *CAFDeserializer) ExtractFileToWriter(filePath string, w io.Writer) (int64, error) {
+	return d.extractFileToWriter(context.Background(), filePath, w)
+}
+
+// extractFileToWriter streams a file into w, aborting once ctx is cancelled
+func (d *CAFDeserializer) extractFileToWriter(ctx context.Context, filePath string, w io.Writer) (int64, error) {
+	if d.index == nil {
+		return 0, fmt.Errorf("index not loaded, call LoadIndex() first")
+	}
+
+	fileMetadata, exists := d.index.Files[filePath]
+	if !exists {
+		return 0, fmt.Errorf("%w: '%s'", ErrFileNotFound, filePath)
+	}
+
+	w = newProgressWriter(w, d.progress, filePath, fileMetadata.Size())
+
+	// Encrypted files can only be authenticated as a whole, so they are buffered
+	if fileMetadata.Encrypted {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		data, err := d.ExtractFile(filePath)
+		if err != nil {
+			return 0, err
+		}
+		written, err := w.Write(data)
+		if err != nil {
+			return int64(written), fmt.Errorf("failed to copy file data: %w", err)
+		}
+		return int64(written), nil
+	}
+
+	fileSize, err := d.storedLength(filePath, fileMetadata)
+	if err != nil {
+		return 0, err
+	}
+	section := io.NewSectionReader(d.reader, fileMetadata.StartByte, fileSize)
+	reader := &contextReader{ctx: ctx, reader: bufio.NewReaderSize(section, extractBufferSize)}
+
+	if fileMetadata.Compression == CompressionNone {
+		written, err := io.CopyN(w, reader, fileSize)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return written, ctxErr
+			}
+			return written, fmt.Errorf("failed to copy file data: %w", err)
+		}
+		return written, nil
+	}
+
+	decoder, err := newDecompressor(fileMetadata.Compression, io.LimitReader(reader, fileSize))
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = decoder.Close() }()
+
+	written, err := io.Copy(w, decoder)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return written, ctxErr
+		}
+		return written, fmt.Errorf("failed to decompress file data: %w", err)
+	}
+
+	return written, nil
+}
+
+// OpenFile returns a seekable view of a single file within the archive, bounded
+// to its byte range. Seeking past the end is allowed and subsequent reads return
+// io.EOF. Compressed and encrypted entries cannot be opened for random access.
+func (d *CAFDeserializer) OpenFile(filePath string) (io.ReadSeekCloser, error) {
+	if d.index == nil {
+		return nil, fmt.Errorf("index not loaded, call LoadIndex() first")
 	}
 
-	endByte := s.currentPos + contentLength
-	duration := time.Since(startTime)
-	throughput := float64(contentLength) / 1024 / 1024 / duration.Seconds() // MB/s
+	fileMetadata, exists := d.index.Files[filePath]
+	if !exists {
+		return nil, fmt.Errorf("%w: '%s'", ErrFileNotFound, filePath)
+	}
 
-	fmt.Printf("CAF: Finished streaming %s in %v (%.2f MB/s)\n", filePath, duration, throughput)
-	fmt.Printf("CAF: File added to index: %d to %d\n", startByte, endByte)
+	if fileMetadata.Compression != CompressionNone {
+		return nil, fmt.Errorf("file '%s' is %s-compressed and cannot be opened for random access", filePath, fileMetadata.Compression)
+	}
+	if fileMetadata.Encrypted {
+		return nil, fmt.Errorf("file '%s' is encrypted and cannot be opened for random access", filePath)
+	}
 
-	// Add to index
-	s.fileIndex[filePath] = CAFFileMetadata{
-		StartByte: startByte,
-		EndByte:   endByte,
+	fileSize, err := d.storedLength(filePath, fileMetadata)
+	if err != nil {
+		return nil, err
 	}
 
-	s.currentPos = endByte
-	fmt.Printf("CAF: New position: %d\n", s.currentPos)
+	// Path-based archives get a dedicated handle so the view outlives Close on the deserializer
+	reader := d.reader
+	var closer io.Closer
+	if d.closer != nil {
+		file, err := os.Open(d.archivePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open archive file: %w", err)
+		}
+		reader = file
+		closer = file
+	}
 
-	return true, nil
+	return &entryReader{
+		SectionReader: io.NewSectionReader(reader, fileMetadata.StartByte, fileSize),
+		closer:        closer,
+	}, nil
 }
 
-// AddFileFromPath adds a file from filesystem to the CAF archive
-func (s *CAFSerializer) AddFileFromPath(filePath string, sourceFilePath string) (bool, error) {
-	data, err := os.ReadFile(sourceFilePath)
-	if err != nil {
-		return false, fmt.Errorf("failed to read source file: %w", err)
-	}
-	return s.AddFile(filePath, data)
+// entryReader is a read-only, seekable view of one archive entry
+type entryReader struct {
+	*io.SectionReader
+	closer io.Closer
 }
 
-// Cleanup frees resources used by the serializer
-func (s *CAFSerializer) Cleanup() error {
-	var err error
-	if s.writer != nil {
-		err = s.writer.Flush()
-		s.writer = nil
-	}
-	if s.file != nil {
-		if closeErr := s.file.Close(); closeErr != nil && err == nil {
-			err = closeErr
-		}
-		s.file = nil
+// Close releases the archive handle backing the view
+func (r *entryReader) Close() error {
+	if r.closer == nil {
+		return nil
 	}
-	// Clear the file index to free memory
-	s.fileIndex = make(map[string]CAFFileMetadata)
+	err := r.closer.Close()
+	r.closer = nil
 	return err
 }
 
-// Finalize completes the CAF archive by writing the index and footer
-func (s *CAFSerializer) Finalize() (string, error) {
-	fmt.Printf("CAF: Starting finalization of %s\n", s.outputPath)
-	fmt.Printf("CAF: Final size: %d bytes\n", s.currentPos)
-	fmt.Printf("CAF: Total files: %d\n", len(s.fileIndex))
+// ExtractFileToPath extracts a file and saves it to the filesystem, restoring its
+// recorded permissions and modification time when the archive has them
+func (d *CAFDeserializer) ExtractFileToPath(filePath string, outputPath string) error {
+	return d.extractFileToPath(context.Background(), filePath, outputPath)
+}
 
-	// Create the index
-	index := CAFIndex{
-		FormatVersion: "1.0",
-		Files:         s.fileIndex,
+// extractFileToPath extracts a file to the filesystem, removing the partially
+// written output if the copy fails or ctx is cancelled
+func (d *CAFDeserializer) extractFileToPath(ctx context.Context, filePath string, outputPath string) error {
+	if d.index == nil {
+		return fmt.Errorf("index not loaded, call LoadIndex() first")
 	}
 
-	indexJSON, err := json.Marshal(index)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal index: %w", err)
+	fileMetadata, exists := d.index.Files[filePath]
+	if !exists {
+		return fmt.Errorf("%w: '%s'", ErrFileNotFound, filePath)
 	}
 
-	indexSize := len(indexJSON)
-	fmt.Printf("CAF: Index size: %d bytes\n", indexSize)
-
-	// Write index
-	n, err := s.writer.Write(indexJSON)
-	if err != nil {
-		return "", fmt.Errorf("failed to write index: %w", err)
-	}
-	if n != indexSize {
-		return "", fmt.Errorf("incomplete index write: wrote %d bytes, expected %d", n, indexSize)
+	// Ensure output directory exists
+	outputDir := filepath.Dir(outputPath)
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	// Write footer (index size as 4-byte little-endian uint32)
-	footerBuffer := make([]byte, 4)
-	binary.LittleEndian.PutUint32(footerBuffer, uint32(indexSize))
-
-	n, err = s.writer.Write(footerBuffer)
+	outFile, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
 	if err != nil {
-		return "", fmt.Errorf("failed to write footer: %w", err)
-	}
-	if n != 4 {
-		return "", fmt.Errorf("incomplete footer write: wrote %d bytes, expected 4", n)
+		return fmt.Errorf("failed to create output file: %w", err)
 	}
 
-	// Flush and close
-	if err := s.writer.Flush(); err != nil {
-		return "", fmt.Errorf("failed to flush writer: %w", err)
+	if _, err := d.extractFileToWriter(ctx, filePath, outFile); err != nil {
+		_ = outFile.Close()
+		_ = os.Remove(outputPath)
+		return err
 	}
 
-	if err := s.file.Close(); err != nil {
-		return "", fmt.Errorf("failed to close file: %w", err)
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("failed to close output file: %w", err)
 	}
 
-	finalSize := s.currentPos + int64(indexSize) + 4
-	fmt.Printf("CAF: Successfully finalized %s\n", s.outputPath)
-	fmt.Printf("CAF: Final archive size: %d bytes\n", finalSize)
+	if fileMetadata.Mode != 0 {
+		if err := os.Chmod(outputPath, os.FileMode(fileMetadata.Mode).Perm()); err != nil {
+			return fmt.Errorf("failed to restore file mode: %w", err)
+		}
+	}
 
-	// Clear resources
-	s.writer = nil
-	s.file = nil
+	if fileMetadata.ModTime != nil {
+		if err := os.Chtimes(outputPath, *fileMetadata.ModTime, *fileMetadata.ModTime); err != nil {
+			return fmt.Errorf("failed to restore modification time: %w", err)
+		}
+	}
 
-	return s.outputPath, nil
+	return nil
 }
 
-// GetArchivePath returns the current archive file path
-func (s *CAFSerializer) GetArchivePath() string {
-	return s.outputPath
+// ExtractAll extracts all files from the archive to a directory
+func (d *CAFDeserializer) ExtractAll(outputDir string) error {
+	return d.ExtractAllConcurrentContext(context.Background(), outputDir, 1)
 }
 
-// GetCurrentSize returns the current size of the archive in bytes
-func (s *CAFSerializer) GetCurrentSize() int64 {
-	return s.currentPos
+// ExtractAllContext extracts all files from the archive to a directory, stopping
+// with ctx.Err() once ctx is cancelled. A file interrupted mid-copy is removed.
+func (d *CAFDeserializer) ExtractAllContext(ctx context.Context, outputDir string) error {
+	return d.ExtractAllConcurrentContext(ctx, outputDir, 1)
 }
 
-// GetFileList returns the list of files currently in the archive
-func (s *CAFSerializer) GetFileList() []string {
-	files := make([]string, 0, len(s.fileIndex))
-	for filePath := range s.fileIndex {
-		files = append(files, filePath)
-	}
-	return files
+// ExtractAllConcurrent extracts all files from the archive to a directory using
+// the given number of workers, which share the archive's io.ReaderAt.
+// The first error stops any remaining work and is returned.
+func (d *CAFDeserializer) ExtractAllConcurrent(outputDir string, workers int) error {
+	return d.ExtractAllConcurrentContext(context.Background(), outputDir, workers)
 }
 
-// GetMaxSize returns the current size limit in bytes
-func (s *CAFSerializer) GetMaxSize() int64 {
-	return s.maxChunkSize
+// ExtractAllConcurrentContext is ExtractAllConcurrent with cancellation: once ctx
+// is cancelled no new files are started, in-flight copies abort and ctx.Err() is returned.
+func (d *CAFDeserializer) ExtractAllConcurrentContext(ctx context.Context, outputDir string, workers int) error {
+	files, err := d.GetFileList()
+	if err != nil {
+		return err
+	}
+	return d.ExtractFilesConcurrentContext(ctx, outputDir, files, workers)
 }
 
-// GetMaxSizeGB returns the current size limit in GB
-func (s *CAFSerializer) GetMaxSizeGB() float64 {
-	return float64(s.maxChunkSize) / (1024 * 1024 * 1024)
+// MatchFiles returns the archive paths matching pattern, sorted by path. A pattern
+// containing glob metacharacters is matched against whole paths with path.Match;
+// any other pattern selects paths starting with it, e.g. "images/".
+func (d *CAFDeserializer) MatchFiles(pattern string) ([]string, error) {
+	files, err := d.GetFileList()
+	if err != nil {
+		return nil, err
+	}
+	return matchPaths(files, pattern)
 }
 
-// CAFDeserializer reads files from CAF archive files
-type CAFDeserializer struct {
-	archivePath string
-	index       *CAFIndex
-	fileSize    int64
-}
+// matchPaths returns the paths of files matching pattern, as MatchFiles describes
+func matchPaths(files []string, pattern string) ([]string, error) {
+	isGlob := strings.ContainsAny(pattern, "*?[\\")
+	if isGlob {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+		}
+	}
 
-// NewCAFDeserializer creates a new CAF deserializer
-func NewCAFDeserializer(archivePath string) *CAFDeserializer {
-	return &CAFDeserializer{
-		archivePath: archivePath,
+	matches := make([]string, 0)
+	for _, filePath := range files {
+		if isGlob {
+			if matched, _ := path.Match(pattern, filePath); matched {
+				matches = append(matches, filePath)
+			}
+		} else if strings.HasPrefix(filePath, pattern) {
+			matches = append(matches, filePath)
+		}
 	}
+	return matches, nil
 }
 
-// LoadIndex loads the CAF index for fast file lookups
-func (d *CAFDeserializer) LoadIndex() error {
-	// Get file size
-	fileInfo, err := os.Stat(d.archivePath)
+// ExtractMatching extracts only the files matching pattern (see MatchFiles) to a
+// directory and returns how many were extracted. A pattern matching nothing
+// returns zero so callers can report it.
+func (d *CAFDeserializer) ExtractMatching(outputDir string, pattern string) (int, error) {
+	matches, err := d.MatchFiles(pattern)
 	if err != nil {
-		return fmt.Errorf("failed to stat archive file: %w", err)
+		return 0, err
+	}
+	if len(matches) == 0 {
+		return 0, nil
 	}
-	d.fileSize = fileInfo.Size()
 
-	// Open file for reading
-	file, err := os.Open(d.archivePath)
-	if err != nil {
-		return fmt.Errorf("failed to open archive file: %w", err)
+	if err := d.ExtractFilesConcurrentContext(context.Background(), outputDir, matches, 1); err != nil {
+		return 0, err
 	}
-	defer func() { _ = file.Close() }()
+	return len(matches), nil
+}
 
-	// Read footer (last 4 bytes)
-	footerBuffer := make([]byte, 4)
-	_, err = file.ReadAt(footerBuffer, d.fileSize-4)
-	if err != nil {
-		return fmt.Errorf("failed to read footer: %w", err)
+// ExtractFilesConcurrentContext extracts the given archive paths to a directory,
+// in order, using the given number of workers. Cancellation and error handling
+// follow ExtractAllConcurrentContext.
+func (d *CAFDeserializer) ExtractFilesConcurrentContext(ctx context.Context, outputDir string, files []string, workers int) error {
+	if d.index == nil {
+		return fmt.Errorf("index not loaded, call LoadIndex() first")
 	}
 
-	indexSize := binary.LittleEndian.Uint32(footerBuffer)
+	if workers < 1 {
+		workers = 1
+	}
 
-	// Read index
-	indexBuffer := make([]byte, indexSize)
-	indexStart := d.fileSize - 4 - int64(indexSize)
-	_, err = file.ReadAt(indexBuffer, indexStart)
-	if err != nil {
-		return fmt.Errorf("failed to read index: %w", err)
+	// Resolve every output path up front so a missing or malicious entry aborts
+	// extraction before anything is written
+	outputPaths := make(map[string]string, len(files))
+	for _, filePath := range files {
+		if _, exists := d.index.Files[filePath]; !exists {
+			return fmt.Errorf("%w: '%s'", ErrFileNotFound, filePath)
+		}
+		outputPath, err := safeJoin(outputDir, filePath)
+		if err != nil {
+			return err
+		}
+		outputPaths[filePath] = outputPath
 	}
 
-	// Parse index
-	var index CAFIndex
-	if err := json.Unmarshal(indexBuffer, &index); err != nil {
-		return fmt.Errorf("failed to parse index: %w", err)
+	// Ensure output directory exists
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	d.index = &index
-	return nil
-}
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	jobs := make(chan string)
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
 
-// GetFileList returns all files in the archive
-func (d *CAFDeserializer) GetFileList() ([]string, error) {
-	if d.index == nil {
-		return nil, fmt.Errorf("index not loaded, call LoadIndex() first")
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filePath := range jobs {
+				if err := d.extractFileToPath(workCtx, filePath, outputPaths[filePath]); err != nil {
+					fail(fmt.Errorf("failed to extract file '%s': %w", filePath, err))
+					return
+				}
+			}
+		}()
 	}
 
-	files := make([]string, 0, len(d.index.Files))
-	for filePath := range d.index.Files {
-		files = append(files, filePath)
+	// Distribute files in order until everything is queued, a worker fails or ctx is cancelled
+dispatch:
+	for _, filePath := range files {
+		select {
+		case jobs <- filePath:
+		case <-workCtx.Done():
+			break dispatch
+		}
 	}
-	return files, nil
-}
+	close(jobs)
+	wg.Wait()
 
-// HasFile checks if a file exists in the archive
-func (d *CAFDeserializer) HasFile(filePath string) (bool, error) {
-	if d.index == nil {
-		return false, fmt.Errorf("index not loaded, call LoadIndex() first")
+	// Report cancellation of the caller's context as-is
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	_, exists := d.index.Files[filePath]
-	return exists, nil
+	return firstErr
 }
 
-// ExtractFile extracts a specific file from the archive
-func (d *CAFDeserializer) ExtractFile(filePath string) ([]byte, error) {
+// VerifyFile re-reads a file's byte range and compares it against the stored checksum.
+// Entries without a checksum (legacy archives) are reported as valid if their
+// byte range is.
+func (d *CAFDeserializer) VerifyFile(filePath string) (bool, error) {
 	if d.index == nil {
-		return nil, fmt.Errorf("index not loaded, call LoadIndex() first")
+		return false, fmt.Errorf("index not loaded, call LoadIndex() first")
 	}
 
 	fileMetadata, exists := d.index.Files[filePath]
 	if !exists {
-		return nil, fmt.Errorf("file '%s' not found in archive", filePath)
-	}
-
-	fileSize := fileMetadata.EndByte - fileMetadata.StartByte
-	buffer := make([]byte, fileSize)
-
-	file, err := os.Open(d.archivePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open archive file: %w", err)
+		return false, fmt.Errorf("%w: '%s'", ErrFileNotFound, filePath)
 	}
-	defer func() { _ = file.Close() }()
 
-	_, err = file.ReadAt(buffer, fileMetadata.StartByte)
+	fileSize, err := d.storedLength(filePath, fileMetadata)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file data: %w", err)
+		return false, err
 	}
-
-	return buffer, nil
-}
-
-// ExtractFileToPath extracts a file and saves it to the filesystem
-func (d *CAFDeserializer) ExtractFileToPath(filePath string, outputPath string) error {
-	fileData, err := d.ExtractFile(filePath)
-	if err != nil {
-		return err
+	if fileMetadata.SHA256 == "" {
+		return true, nil
 	}
 
-	// Ensure output directory exists
-	outputDir := filepath.Dir(outputPath)
-	if err := os.MkdirAll(outputDir, 0o755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(d.reader, fileMetadata.StartByte, fileSize)); err != nil {
+		return false, fmt.Errorf("failed to read file data: %w", err)
 	}
 
-	return os.WriteFile(outputPath, fileData, 0o644)
+	return hex.EncodeToString(hasher.Sum(nil)) == fileMetadata.SHA256, nil
 }
 
-// ExtractAll extracts all files from the archive to a directory
-func (d *CAFDeserializer) ExtractAll(outputDir string) error {
-	if d.index == nil {
-		return fmt.Errorf("index not loaded, call LoadIndex() first")
-	}
-
-	// Ensure output directory exists
-	if err := os.MkdirAll(outputDir, 0o755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+// safeJoin resolves an archive path under outputDir, rejecting absolute paths
+// and entries that would escape outputDir (Zip Slip)
+func safeJoin(outputDir, archivePath string) (string, error) {
+	localPath := filepath.FromSlash(archivePath)
+	if archivePath == "" || filepath.IsAbs(localPath) || strings.HasPrefix(archivePath, "/") || filepath.VolumeName(localPath) != "" {
+		return "", fmt.Errorf("unsafe path in archive: entry '%s' is absolute or empty", archivePath)
 	}
 
-	// Extract each file
-	for filePath := range d.index.Files {
-		outputPath := filepath.Join(outputDir, filePath)
-
-		// Ensure subdirectories exist
-		fileDir := filepath.Dir(outputPath)
-		if err := os.MkdirAll(fileDir, 0o755); err != nil {
-			return fmt.Errorf("failed to create file directory: %w", err)
-		}
-
-		if err := d.ExtractFileToPath(filePath, outputPath); err != nil {
-			return fmt.Errorf("failed to extract file '%s': %w", filePath, err)
-		}
+	outputPath := filepath.Join(outputDir, localPath)
+	relPath, err := filepath.Rel(filepath.Clean(outputDir), outputPath)
+	if err != nil || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("unsafe path in archive: entry '%s' escapes the output directory", archivePath)
 	}
 
-	return nil
+	return outputPath, nil
 }
 
 // GetFileMetadata gets metadata for a specific file
@@ -421,10 +1790,11 @@ func (d *CAFDeserializer) GetFileMetadata(filePath string) (*CAFFileMetadata, er
 		return nil, fmt.Errorf("index not loaded, call LoadIndex() first")
 	}
 
-	if metadata, exists := d.index.Files[filePath]; exists {
-		return &metadata, nil
+	metadata, exists := d.index.Files[filePath]
+	if !exists {
+		return nil, fmt.Errorf("%w: '%s'", ErrFileNotFound, filePath)
 	}
-	return nil, nil
+	return &metadata, nil
 }
 
 // GetFormatVersion gets the CAF format version
@@ -436,12 +1806,26 @@ func (d *CAFDeserializer) GetFormatVersion() (string, error) {
 }
 
 // CAFUtils provides utility functions for CAF operations
-type CAFUtils struct{}
+type CAFUtils struct {
+	AllowLegacy bool // Accept archives written without the magic header
+}
 
-// ValidateArchive validates a CAF archive structure
-func (u *CAFUtils) ValidateArchive(archivePath string) (bool, error) {
+// newDeserializer creates a deserializer honoring the utils' settings
+func (u *CAFUtils) newDeserializer(archivePath string) *CAFDeserializer {
 	deserializer := NewCAFDeserializer(archivePath)
+	deserializer.SetAllowLegacy(u.AllowLegacy)
+	return deserializer
+}
+
+// ValidateArchive validates a CAF archive structure. When verifyChecksums is set,
+// every file's bytes are re-read and compared against the checksums in the index.
+func (u *CAFUtils) ValidateArchive(archivePath string, verifyChecksums bool) (bool, error) {
+	deserializer := u.newDeserializer(archivePath)
+	defer func() { _ = deserializer.Close() }()
 	if err := deserializer.LoadIndex(); err != nil {
+		if errors.Is(err, ErrNotCAFArchive) {
+			return false, nil
+		}
 		return false, err
 	}
 
@@ -451,26 +1835,145 @@ func (u *CAFUtils) ValidateArchive(archivePath string) (bool, error) {
 		return false, err
 	}
 
-	return version == "1.0", nil
+	if version != "1.0" {
+		return false, nil
+	}
+
+	if !verifyChecksums {
+		return true, nil
+	}
+
+	fileList, err := deserializer.GetFileList()
+	if err != nil {
+		return false, err
+	}
+
+	for _, filePath := range fileList {
+		valid, err := deserializer.VerifyFile(filePath)
+		if err != nil {
+			return false, fmt.Errorf("failed to verify file '%s': %w", filePath, err)
+		}
+		if !valid {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// ValidationIssue describes a problem found by DeepValidate. Path is empty for
+// issues that concern the archive as a whole rather than a single entry. A
+// warning, such as unreferenced bytes, wastes space but leaves every file readable.
+type ValidationIssue struct {
+	Path        string `json:"path,omitempty"`
+	Description string `json:"description"`
+	Warning     bool   `json:"warning,omitempty"`
+}
+
+// DeepValidate cross-checks every index entry against the archive layout: each
+// byte range must lie between the header and the index, ranges may only overlap
+// when they are identical (deduplicated entries), and data bytes left
+// unreferenced, e.g. by an entry replaced with SetOverwrite, are reported as
+// warnings. The archive is structurally sound when every issue is a warning.
+func (u *CAFUtils) DeepValidate(archivePath string) ([]ValidationIssue, error) {
+	deserializer := u.newDeserializer(archivePath)
+	defer func() { _ = deserializer.Close() }()
+	if err := deserializer.LoadIndex(); err != nil {
+		return nil, err
+	}
+
+	issues := make([]ValidationIssue, 0)
+	addIssue := func(filePath string, format string, args ...any) {
+		issues = append(issues, ValidationIssue{Path: filePath, Description: fmt.Sprintf(format, args...)})
+	}
+	addWarning := func(format string, args ...any) {
+		issues = append(issues, ValidationIssue{Description: fmt.Sprintf(format, args...), Warning: true})
+	}
+
+	fileList, err := deserializer.GetFileList()
+	if err != nil {
+		return nil, err
+	}
+
+	// Check each entry's bounds on its own
+	inBounds := make(map[string]CAFFileMetadata, len(fileList))
+	for _, filePath := range fileList {
+		metadata := deserializer.index.Files[filePath]
+		switch {
+		case metadata.StartByte < 0:
+			addIssue(filePath, "negative start byte %d", metadata.StartByte)
+		case metadata.EndByte < metadata.StartByte:
+			addIssue(filePath, "end byte %d precedes start byte %d", metadata.EndByte, metadata.StartByte)
+		case metadata.StartByte < deserializer.dataStart:
+			addIssue(filePath, "start byte %d lies inside the %d-byte header", metadata.StartByte, deserializer.dataStart)
+		case metadata.EndByte > deserializer.fileSize:
+			addIssue(filePath, "byte range [%d, %d) extends past the end of the %d-byte archive", metadata.StartByte, metadata.EndByte, deserializer.fileSize)
+		case metadata.EndByte > deserializer.indexStart:
+			addIssue(filePath, "byte range [%d, %d) extends into the index, which starts at byte %d", metadata.StartByte, metadata.EndByte, deserializer.indexStart)
+		default:
+			inBounds[filePath] = metadata
+		}
+	}
+
+	// Walk the in-bounds ranges in offset order looking for overlaps and gaps
+	covered := deserializer.dataStart
+	var prevPath string
+	var prev CAFFileMetadata
+	for _, filePath := range entriesByOffset(inBounds) {
+		metadata := inBounds[filePath]
+		if metadata.StartByte == metadata.EndByte {
+			continue // Empty files occupy no bytes
+		}
+
+		if prevPath != "" && metadata.StartByte < prev.EndByte &&
+			(metadata.StartByte != prev.StartByte || metadata.EndByte != prev.EndByte) {
+			addIssue(filePath, "byte range [%d, %d) overlaps '%s' at [%d, %d)", metadata.StartByte, metadata.EndByte, prevPath, prev.StartByte, prev.EndByte)
+		}
+		if metadata.StartByte > covered {
+			addWarning("bytes [%d, %d) are not referenced by any entry", covered, metadata.StartByte)
+		}
+
+		if metadata.EndByte > covered {
+			covered = metadata.EndByte
+			prevPath, prev = filePath, metadata
+		}
+	}
+	if covered < deserializer.indexStart {
+		addWarning("bytes [%d, %d) are not referenced by any entry", covered, deserializer.indexStart)
+	}
+
+	// Without a footer the index should end the archive
+	if deserializer.version == headerVersionIndexOffset && deserializer.indexEnd < deserializer.fileSize {
+		addIssue("", "bytes [%d, %d) follow the index", deserializer.indexEnd, deserializer.fileSize)
+	}
+
+	return issues, nil
 }
 
-// ArchiveStats represents statistics about a CAF archive
+// ArchiveStats represents statistics about a CAF archive. TotalSize is the size
+// of the archive file and always equals DataSize + OverheadSize.
 type ArchiveStats struct {
 	TotalFiles    int        `json:"total_files"`
-	TotalSize     int64      `json:"total_size"`
+	TotalSize     int64      `json:"total_size"`    // Archive file size
+	DataSize      int64      `json:"data_size"`     // Bytes of the data region holding file contents
+	OverheadSize  int64      `json:"overhead_size"` // Bytes of header, index and footer
+	ContentSize   int64      `json:"content_size"`  // Sum of the files' logical sizes
 	FormatVersion string     `json:"format_version"`
 	Files         []FileInfo `json:"files"`
 }
 
 // FileInfo represents information about a file in the archive
 type FileInfo struct {
-	Path string `json:"path"`
-	Size int64  `json:"size"`
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`        // Logical size, as extracted
+	StoredSize  int64  `json:"stored_size"` // Bytes occupied in the archive, after compression or encryption
+	ContentType string `json:"content_type,omitempty"`
 }
 
 // GetArchiveStats gets archive statistics
 func (u *CAFUtils) GetArchiveStats(archivePath string) (*ArchiveStats, error) {
-	deserializer := NewCAFDeserializer(archivePath)
+	deserializer := u.newDeserializer(archivePath)
+	defer func() { _ = deserializer.Close() }()
 	if err := deserializer.LoadIndex(); err != nil {
 		return nil, err
 	}
@@ -480,23 +1983,24 @@ func (u *CAFUtils) GetArchiveStats(archivePath string) (*ArchiveStats, error) {
 		return nil, err
 	}
 
-	fileInfo, err := os.Stat(archivePath)
-	if err != nil {
-		return nil, err
-	}
-
 	files := make([]FileInfo, len(fileList))
+	contentSize := int64(0)
 	for i, filePath := range fileList {
 		metadata, err := deserializer.GetFileMetadata(filePath)
 		if err != nil {
 			return nil, err
 		}
 		files[i] = FileInfo{
-			Path: filePath,
-			Size: metadata.EndByte - metadata.StartByte,
+			Path:        filePath,
+			Size:        metadata.Size(),
+			StoredSize:  metadata.StoredSize(),
+			ContentType: metadata.ContentType,
 		}
+		contentSize += files[i].Size
 	}
 
+	dataSize := deserializer.indexStart - deserializer.dataStart
+
 	version, err := deserializer.GetFormatVersion()
 	if err != nil {
 		return nil, err
@@ -504,7 +2008,10 @@ func (u *CAFUtils) GetArchiveStats(archivePath string) (*ArchiveStats, error) {
 
 	return &ArchiveStats{
 		TotalFiles:    len(fileList),
-		TotalSize:     fileInfo.Size(),
+		TotalSize:     deserializer.fileSize,
+		DataSize:      dataSize,
+		OverheadSize:  deserializer.fileSize - dataSize,
+		ContentSize:   contentSize,
 		FormatVersion: version,
 		Files:         files,
 	}, nil
@@ -0,0 +1,438 @@
+package caf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+)
+
+// craftArchive writes an archive with a plain JSON index holding files as given,
+// so tests can describe entries no serializer would produce
+func craftArchive(t *testing.T, data []byte, files map[string]CAFFileMetadata) string {
+	t.Helper()
+
+	indexData, err := encodeIndex(CAFIndex{FormatVersion: "1.0", Files: files}, headerVersionPlainIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := newHeader(headerVersionPlainIndex)
+	archive = append(archive, data...)
+	archive = append(archive, indexData...)
+	archive = binary.LittleEndian.AppendUint32(archive, uint32(len(indexData)))
+
+	archivePath := filepath.Join(t.TempDir(), "crafted.caf")
+	if err := os.WriteFile(archivePath, archive, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return archivePath
+}
+
+func TestByteRangesOutsideDataAreRejected(t *testing.T) {
+	data := []byte("hello")
+	start := headerSize
+	archivePath := craftArchive(t, data, map[string]CAFFileMetadata{
+		"ok.txt":       {StartByte: start, EndByte: start + int64(len(data))},
+		"huge.bin":     {StartByte: start, EndByte: 1 << 40},
+		"index.bin":    {StartByte: start, EndByte: start + int64(len(data)) + 2},
+		"header.bin":   {StartByte: 0, EndByte: start},
+		"inverted.bin": {StartByte: start + 3, EndByte: start + 1},
+	})
+
+	deserializer := NewCAFDeserializer(archivePath)
+	defer func() { _ = deserializer.Close() }()
+	if err := deserializer.LoadIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := deserializer.ExtractFile("ok.txt"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("ExtractFile(ok.txt) = %q, %v", got, err)
+	}
+
+	for _, filePath := range []string{"huge.bin", "index.bin", "header.bin", "inverted.bin"} {
+		if _, err := deserializer.ExtractFile(filePath); err == nil {
+			t.Errorf("ExtractFile(%s) succeeded", filePath)
+		}
+		if _, err := deserializer.ExtractFileToWriter(filePath, &bytes.Buffer{}); err == nil {
+			t.Errorf("ExtractFileToWriter(%s) succeeded", filePath)
+		}
+		if reader, err := deserializer.OpenFile(filePath); err == nil {
+			_ = reader.Close()
+			t.Errorf("OpenFile(%s) succeeded", filePath)
+		}
+		if _, err := deserializer.VerifyFile(filePath); err == nil {
+			t.Errorf("VerifyFile(%s) succeeded", filePath)
+		}
+	}
+}
+
+func TestArchiveOfEmptyFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *CAFSerializer) error
+	}{
+		{name: "default", setup: func(*CAFSerializer) error { return nil }},
+		{name: "plain index", setup: func(s *CAFSerializer) error { return s.SetCompressIndex(false) }},
+		{name: "header index", setup: func(s *CAFSerializer) error { return s.SetHeaderIndexOffset(true) }},
+		{name: "spill index", setup: func(s *CAFSerializer) error { return s.SetSpillIndex(true) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sourcePath := filepath.Join(dir, "empty.src")
+			if err := os.WriteFile(sourcePath, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			archivePath := filepath.Join(dir, "empty.caf")
+			serializer, err := NewCAFSerializer(archivePath, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = serializer.Cleanup() }()
+			if err := tt.setup(serializer); err != nil {
+				t.Fatal(err)
+			}
+
+			adds := map[string]func() (bool, error){
+				"bytes.txt":      func() (bool, error) { return serializer.AddFile("bytes.txt", nil) },
+				"compressed.txt": func() (bool, error) { return serializer.AddFileCompressed("compressed.txt", []byte{}) },
+				"reader.txt": func() (bool, error) {
+					return serializer.AddFileFromReader("reader.txt", bytes.NewReader(nil), 0)
+				},
+				"dir/path.txt": func() (bool, error) { return serializer.AddFileFromPath("dir/path.txt", sourcePath) },
+			}
+			for filePath, add := range adds {
+				if added, err := add(); err != nil || !added {
+					t.Fatalf("adding %s: added=%v, err=%v", filePath, added, err)
+				}
+			}
+			if _, err := serializer.Finalize(); err != nil {
+				t.Fatal(err)
+			}
+
+			deserializer := NewCAFDeserializer(archivePath)
+			defer func() { _ = deserializer.Close() }()
+			if err := deserializer.LoadIndex(); err != nil {
+				t.Fatal(err)
+			}
+
+			fileList, err := deserializer.GetFileList()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fileList) != len(adds) {
+				t.Fatalf("archive lists %d files, want %d: %v", len(fileList), len(adds), fileList)
+			}
+
+			for filePath := range adds {
+				data, err := deserializer.ExtractFile(filePath)
+				if err != nil || len(data) != 0 {
+					t.Errorf("ExtractFile(%s) = %q, %v", filePath, data, err)
+				}
+				// Empty content never shrinks, so even AddFileCompressed stores it raw
+				reader, err := deserializer.OpenFile(filePath)
+				if err != nil {
+					t.Errorf("OpenFile(%s): %v", filePath, err)
+					continue
+				}
+				_ = reader.Close()
+			}
+
+			outputDir := filepath.Join(dir, "out")
+			if err := deserializer.ExtractAll(outputDir); err != nil {
+				t.Fatal(err)
+			}
+			for filePath := range adds {
+				info, err := os.Stat(filepath.Join(outputDir, filepath.FromSlash(filePath)))
+				if err != nil || info.Size() != 0 {
+					t.Errorf("extracted %s: info=%v, err=%v", filePath, info, err)
+				}
+			}
+
+			utils := &CAFUtils{}
+			if valid, err := utils.ValidateArchive(archivePath, true); err != nil || !valid {
+				t.Errorf("ValidateArchive = %v, %v", valid, err)
+			}
+			issues, err := utils.DeepValidate(archivePath)
+			if err != nil || len(issues) != 0 {
+				t.Errorf("DeepValidate = %v, %v", issues, err)
+			}
+			stats, err := utils.GetArchiveStats(archivePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.TotalFiles != len(adds) || stats.DataSize != 0 || stats.ContentSize != 0 {
+				t.Errorf("stats: %d files, %d data bytes, %d content bytes", stats.TotalFiles, stats.DataSize, stats.ContentSize)
+			}
+		})
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	outputDir := filepath.Join(t.TempDir(), "out")
+	tests := []struct {
+		archivePath string
+		want        string // Empty when the path must be rejected
+	}{
+		{archivePath: "file.txt", want: filepath.Join(outputDir, "file.txt")},
+		{archivePath: "dir/sub/file.txt", want: filepath.Join(outputDir, "dir", "sub", "file.txt")},
+		{archivePath: "dir/../file.txt", want: filepath.Join(outputDir, "file.txt")},
+		{archivePath: ""},
+		{archivePath: "."},
+		{archivePath: ".."},
+		{archivePath: "../escape.txt"},
+		{archivePath: "dir/../../escape.txt"},
+		{archivePath: "/etc/passwd"},
+		{archivePath: filepath.ToSlash(filepath.Join(outputDir, "abs.txt"))},
+	}
+
+	for _, tt := range tests {
+		got, err := safeJoin(outputDir, tt.archivePath)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("safeJoin(%q) = %q, want an error", tt.archivePath, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("safeJoin(%q) = %q, %v, want %q", tt.archivePath, got, err, tt.want)
+		}
+	}
+}
+
+func TestExtractRejectsEscapingEntries(t *testing.T) {
+	data := []byte("payload")
+	entry := CAFFileMetadata{StartByte: headerSize, EndByte: headerSize + int64(len(data))}
+
+	tests := map[string]func(root string) string{
+		"parent":   func(string) string { return "../escape.txt" },
+		"nested":   func(string) string { return "dir/../../escape.txt" },
+		"absolute": func(root string) string { return filepath.ToSlash(filepath.Join(root, "escape.txt")) },
+	}
+
+	for name, unsafePathIn := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Everything extraction could reach by escaping lies under root
+			root := t.TempDir()
+			outputDir := filepath.Join(root, "nested", "out")
+			unsafePath := unsafePathIn(root)
+
+			archivePath := craftArchive(t, data, map[string]CAFFileMetadata{
+				"ok.txt":   entry,
+				unsafePath: entry,
+			})
+
+			deserializer := NewCAFDeserializer(archivePath)
+			defer func() { _ = deserializer.Close() }()
+			if err := deserializer.LoadIndex(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := deserializer.ExtractAll(outputDir); err == nil {
+				t.Error("ExtractAll succeeded")
+			}
+			err := deserializer.ExtractFilesConcurrentContext(context.Background(), outputDir, []string{"ok.txt", unsafePath}, 4)
+			if err == nil {
+				t.Error("ExtractFilesConcurrentContext succeeded")
+			}
+
+			// Paths are checked before anything is extracted, so nothing at all is written
+			err = filepath.Walk(root, func(walkPath string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					t.Errorf("extraction wrote '%s'", walkPath)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCleanupRemovesUnfinalizedTempArchive(t *testing.T) {
+	serializer, err := NewCAFSerializer("", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivePath := serializer.GetArchivePath()
+	if _, err := os.Stat(archivePath); err != nil {
+		t.Fatalf("temp archive was not created: %v", err)
+	}
+
+	if _, err := serializer.AddFile("file.txt", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := serializer.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(archivePath); !os.IsNotExist(err) {
+		t.Errorf("temp archive '%s' still exists after Cleanup: %v", archivePath, err)
+	}
+}
+
+func TestCleanupKeepsFinalizedTempArchive(t *testing.T) {
+	serializer, err := NewCAFSerializer("", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivePath, err := serializer.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(archivePath) }()
+
+	if err := serializer.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(archivePath); err != nil {
+		t.Errorf("finalized archive was removed by Cleanup: %v", err)
+	}
+}
+
+func TestOverwrittenEntryOnlyWarns(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "overwrite.caf")
+	serializer, err := NewCAFSerializer(archivePath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = serializer.Cleanup() }()
+
+	if _, err := serializer.AddFile("file.txt", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serializer.AddFile("file.txt", []byte("new")); !errors.Is(err, ErrDuplicatePath) {
+		t.Fatalf("adding a duplicate path: %v, want ErrDuplicatePath", err)
+	}
+	serializer.SetOverwrite(true)
+	if _, err := serializer.AddFile("file.txt", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serializer.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err := (&CAFUtils{}).DeepValidate(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || !issues[0].Warning {
+		t.Fatalf("DeepValidate = %v, want a single warning about the replaced bytes", issues)
+	}
+}
+
+func TestDeduplicatedReaderMustMatchContentLength(t *testing.T) {
+	serializer, err := NewCAFSerializer(filepath.Join(t.TempDir(), "dedup.caf"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = serializer.Cleanup() }()
+	serializer.SetDeduplicate(true)
+
+	content := []byte("0123456789")
+	if _, err := serializer.AddFileFromReader("full", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hashing the whole reader would match "full" and record the wrong size
+	if _, err := serializer.AddFileFromReader("longer", bytes.NewReader(content), 4); err == nil {
+		t.Error("adding a reader longer than its content length succeeded")
+	}
+	if _, err := serializer.AddFileFromReader("shorter", bytes.NewReader(content), 20); err == nil {
+		t.Error("adding a reader shorter than its content length succeeded")
+	}
+	if metadata, exists := serializer.lookupEntry("longer"); exists {
+		t.Errorf("a rejected reader was indexed as %d bytes", metadata.Size())
+	}
+
+	// A reader of exactly the given length is still deduplicated
+	if _, err := serializer.AddFileFromReader("copy", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	full, _ := serializer.lookupEntry("full")
+	duplicate, _ := serializer.lookupEntry("copy")
+	if duplicate.StartByte != full.StartByte || duplicate.EndByte != full.EndByte {
+		t.Errorf("copy stored at [%d, %d), want the range of full [%d, %d)",
+			duplicate.StartByte, duplicate.EndByte, full.StartByte, full.EndByte)
+	}
+}
+
+// TestFailedAppendRestoresArchive writes part of a file through an appender
+// and then abandons it: Cleanup must put the original archive back exactly
+func TestFailedAppendRestoresArchive(t *testing.T) {
+	modes := map[string]func(s *CAFSerializer) error{
+		"default": func(s *CAFSerializer) error { return nil },
+		"plain":   func(s *CAFSerializer) error { return s.SetCompressIndex(false) },
+		"header":  func(s *CAFSerializer) error { return s.SetHeaderIndexOffset(true) },
+	}
+	for name, setup := range modes {
+		t.Run(name, func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "archive.caf")
+			serializer, err := NewCAFSerializer(archivePath, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := setup(serializer); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := serializer.AddFile("original.txt", []byte("original content")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := serializer.Finalize(); err != nil {
+				t.Fatal(err)
+			}
+			before, err := os.ReadFile(archivePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			appender, err := NewCAFAppender(archivePath, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := appender.AddFile("added.txt", []byte("added content")); err != nil {
+				t.Fatal(err)
+			}
+			broken := io.MultiReader(bytes.NewReader(make([]byte, 512)), iotest.ErrReader(errors.New("source went away")))
+			if _, err := appender.AddFileFromReader("broken.bin", broken, 1024); err == nil {
+				t.Fatal("expected the failing reader to fail the append")
+			}
+			if err := appender.Cleanup(); err != nil {
+				t.Fatal(err)
+			}
+
+			after, err := os.ReadFile(archivePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(after, before) {
+				t.Fatal("archive differs from the original after the failed append")
+			}
+
+			deserializer := NewCAFDeserializer(archivePath)
+			defer func() { _ = deserializer.Close() }()
+			if err := deserializer.LoadIndex(); err != nil {
+				t.Fatal(err)
+			}
+			files, err := deserializer.GetFileList()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 || files[0] != "original.txt" {
+				t.Errorf("expected only original.txt, found %v", files)
+			}
+			if data, err := deserializer.ExtractFile("original.txt"); err != nil || string(data) != "original content" {
+				t.Errorf("original.txt: got %q, %v", data, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package caf
+
+import "sort"
+
+// DiffResult lists how the files of one archive differ from another's. Paths are
+// sorted. Unverified holds files whose sizes match but whose checksums could
+// not be compared (older archives, differing codecs or encryption), so equal
+// size is the only evidence they are unchanged.
+type DiffResult struct {
+	Added      []string `json:"added"`
+	Removed    []string `json:"removed"`
+	Modified   []string `json:"modified"`
+	Unverified []string `json:"unverified"`
+}
+
+// Diff compares two archives by their indexes. A file present in both is
+// modified when the checksums of its stored bytes differ, or, when they cannot
+// be compared, when its logical size differs.
+func (u *CAFUtils) Diff(archiveA, archiveB string) (*DiffResult, error) {
+	a := u.newDeserializer(archiveA)
+	defer func() { _ = a.Close() }()
+	if err := a.LoadIndex(); err != nil {
+		return nil, err
+	}
+
+	b := u.newDeserializer(archiveB)
+	defer func() { _ = b.Close() }()
+	if err := b.LoadIndex(); err != nil {
+		return nil, err
+	}
+
+	result := &DiffResult{
+		Added:      make([]string, 0),
+		Removed:    make([]string, 0),
+		Modified:   make([]string, 0),
+		Unverified: make([]string, 0),
+	}
+
+	for filePath, before := range a.index.Files {
+		after, exists := b.index.Files[filePath]
+		if !exists {
+			result.Removed = append(result.Removed, filePath)
+			continue
+		}
+
+		switch {
+		case checksumsComparable(before, after):
+			if before.SHA256 != after.SHA256 {
+				result.Modified = append(result.Modified, filePath)
+			}
+		case before.Size() != after.Size():
+			result.Modified = append(result.Modified, filePath)
+		default:
+			result.Unverified = append(result.Unverified, filePath)
+		}
+	}
+
+	for filePath := range b.index.Files {
+		if _, exists := a.index.Files[filePath]; !exists {
+			result.Added = append(result.Added, filePath)
+		}
+	}
+
+	sort.Strings(result.Added)
+	sort.Strings(result.Removed)
+	sort.Strings(result.Modified)
+	sort.Strings(result.Unverified)
+	return result, nil
+}
+
+// checksumsComparable reports whether equal stored checksums imply equal
+// content, which requires both entries to be stored the same way
+func checksumsComparable(a, b CAFFileMetadata) bool {
+	return a.SHA256 != "" && b.SHA256 != "" &&
+		a.Compression == b.Compression && !a.Encrypted && !b.Encrypted
+}
@@ -0,0 +1,131 @@
+package caf
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeEncryptedArchive stores plain.txt raw and packed.txt compressed under key
+func writeEncryptedArchive(t *testing.T, key []byte, content []byte) string {
+	t.Helper()
+
+	archivePath := filepath.Join(t.TempDir(), "encrypted.caf")
+	serializer, err := NewCAFSerializerEncrypted(archivePath, 1, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = serializer.Cleanup() }()
+
+	if _, err := serializer.AddFile("plain.txt", content); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serializer.AddFileCompressed("packed.txt", content); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serializer.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	return archivePath
+}
+
+// openArchive loads the index of the archive at archivePath, setting key if given
+func openArchive(t *testing.T, archivePath string, key []byte) *CAFDeserializer {
+	t.Helper()
+
+	deserializer := NewCAFDeserializer(archivePath)
+	t.Cleanup(func() { _ = deserializer.Close() })
+	if err := deserializer.LoadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if key != nil {
+		if err := deserializer.SetKey(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return deserializer
+}
+
+// TestEncryptedRoundTrip checks that raw and compressed files come back intact
+// with the key, and that the plaintext never reaches the archive
+func TestEncryptedRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	content := bytes.Repeat([]byte("secret content "), 64)
+	archivePath := writeEncryptedArchive(t, key, content)
+
+	raw, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, content[:32]) {
+		t.Fatal("archive holds the plaintext")
+	}
+
+	deserializer := openArchive(t, archivePath, key)
+	for _, filePath := range []string{"plain.txt", "packed.txt"} {
+		metadata, err := deserializer.GetFileMetadata(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !metadata.Encrypted || metadata.Nonce == "" {
+			t.Errorf("'%s' is not marked as encrypted", filePath)
+		}
+
+		data, err := deserializer.ExtractFile(filePath)
+		if err != nil {
+			t.Fatalf("%s: %v", filePath, err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Errorf("'%s' did not round-trip", filePath)
+		}
+	}
+}
+
+// TestEncryptedFileNeedsTheRightKey checks that extracting without a key, or
+// with a different one, fails instead of returning ciphertext or garbage
+func TestEncryptedFileNeedsTheRightKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	archivePath := writeEncryptedArchive(t, key, []byte("secret content"))
+
+	if _, err := openArchive(t, archivePath, nil).ExtractFile("plain.txt"); !errors.Is(err, ErrKeyRequired) {
+		t.Errorf("without a key: expected ErrKeyRequired, got %v", err)
+	}
+
+	wrongKey := bytes.Repeat([]byte{0x24}, 32)
+	deserializer := openArchive(t, archivePath, wrongKey)
+	for _, filePath := range []string{"plain.txt", "packed.txt"} {
+		if _, err := deserializer.ExtractFile(filePath); !errors.Is(err, ErrDecryptionFailed) {
+			t.Errorf("%s with the wrong key: expected ErrDecryptionFailed, got %v", filePath, err)
+		}
+	}
+}
+
+// TestTamperedCiphertextIsRejected flips one stored bit of a file: GCM
+// authentication must catch it, while the other file still decrypts
+func TestTamperedCiphertextIsRejected(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	archivePath := writeEncryptedArchive(t, key, []byte("secret content"))
+
+	metadata, err := openArchive(t, archivePath, nil).GetFileMetadata("plain.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[metadata.StartByte] ^= 0x01
+	if err := os.WriteFile(archivePath, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	deserializer := openArchive(t, archivePath, key)
+	if _, err := deserializer.ExtractFile("plain.txt"); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("expected ErrDecryptionFailed, got %v", err)
+	}
+	if data, err := deserializer.ExtractFile("packed.txt"); err != nil || string(data) != "secret content" {
+		t.Errorf("untouched file: got %q, %v", data, err)
+	}
+}
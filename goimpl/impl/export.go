@@ -0,0 +1,141 @@
+package caf
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// exportEntry describes one file being written to an exported archive
+type exportEntry struct {
+	path    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// exportFunc writes the given entries to out, streaming each file's contents
+// from the deserializer
+type exportFunc func(out io.Writer, deserializer *CAFDeserializer, entries []exportEntry) error
+
+// ExportTar converts a CAF archive into a tar file. Entries keep their archive
+// paths and, where recorded, their permissions and modification times; files are
+// streamed one at a time without being extracted to disk.
+func (u *CAFUtils) ExportTar(archivePath, outputTar string) error {
+	return u.export(archivePath, outputTar, func(out io.Writer, deserializer *CAFDeserializer, entries []exportEntry) error {
+		tarWriter := tar.NewWriter(out)
+		for _, entry := range entries {
+			header := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     entry.path,
+				Size:     entry.size,
+				Mode:     int64(entry.mode),
+				ModTime:  entry.modTime,
+			}
+			if err := tarWriter.WriteHeader(header); err != nil {
+				return fmt.Errorf("failed to write tar header for '%s': %w", entry.path, err)
+			}
+			if _, err := deserializer.ExtractFileToWriter(entry.path, tarWriter); err != nil {
+				return fmt.Errorf("failed to export file '%s': %w", entry.path, err)
+			}
+		}
+		if err := tarWriter.Close(); err != nil {
+			return fmt.Errorf("failed to finish tar file: %w", err)
+		}
+		return nil
+	})
+}
+
+// ExportZip converts a CAF archive into a deflate-compressed zip file, keeping
+// the same entry attributes as ExportTar
+func (u *CAFUtils) ExportZip(archivePath, outputZip string) error {
+	return u.export(archivePath, outputZip, func(out io.Writer, deserializer *CAFDeserializer, entries []exportEntry) error {
+		zipWriter := zip.NewWriter(out)
+		for _, entry := range entries {
+			header := &zip.FileHeader{
+				Name:     entry.path,
+				Method:   zip.Deflate,
+				Modified: entry.modTime,
+			}
+			header.SetMode(entry.mode)
+
+			writer, err := zipWriter.CreateHeader(header)
+			if err != nil {
+				return fmt.Errorf("failed to write zip header for '%s': %w", entry.path, err)
+			}
+			if _, err := deserializer.ExtractFileToWriter(entry.path, writer); err != nil {
+				return fmt.Errorf("failed to export file '%s': %w", entry.path, err)
+			}
+		}
+		if err := zipWriter.Close(); err != nil {
+			return fmt.Errorf("failed to finish zip file: %w", err)
+		}
+		return nil
+	})
+}
+
+// export loads the archive, checks every path is safe to hand to other tools and
+// runs write against the output file, removing it if the export fails
+func (u *CAFUtils) export(archivePath, outputPath string, write exportFunc) error {
+	deserializer := u.newDeserializer(archivePath)
+	defer func() { _ = deserializer.Close() }()
+	if err := deserializer.LoadIndex(); err != nil {
+		return err
+	}
+
+	archiveInfo, err := os.Stat(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat archive file: %w", err)
+	}
+
+	fileList, err := deserializer.GetFileList()
+	if err != nil {
+		return err
+	}
+
+	// Entries without recorded attributes get regular permissions and the archive's mtime
+	entries := make([]exportEntry, len(fileList))
+	for i, filePath := range fileList {
+		if _, err := safeJoin(".", filePath); err != nil {
+			return err
+		}
+
+		metadata := deserializer.index.Files[filePath]
+		entry := exportEntry{
+			path:    filePath,
+			size:    metadata.Size(),
+			mode:    0o644,
+			modTime: archiveInfo.ModTime(),
+		}
+		if metadata.Mode != 0 {
+			entry.mode = os.FileMode(metadata.Mode)
+		}
+		if metadata.ModTime != nil {
+			entry.modTime = *metadata.ModTime
+		}
+		entries[i] = entry
+	}
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+
+	writer := bufio.NewWriterSize(outFile, extractBufferSize)
+	err = write(writer, deserializer, entries)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := outFile.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("failed to close output file: %w", closeErr)
+	}
+	if err != nil {
+		_ = os.Remove(outputPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package caf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// byteRange identifies a stored byte range in an archive
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// addStoredEntry copies an entry's stored bytes from r verbatim, keeping its
+// checksum, codec and file attributes and assigning it a new byte range
+func (s *CAFSerializer) addStoredEntry(filePath string, r io.Reader, metadata CAFFileMetadata) (CAFFileMetadata, error) {
+	size := metadata.EndByte - metadata.StartByte
+	if s.currentPos+size > s.maxChunkSize {
+		return CAFFileMetadata{}, fmt.Errorf("file '%s' would exceed the archive size limit", filePath)
+	}
+
+	written, err := io.CopyN(s.writer, r, size)
+	if err != nil {
+		return CAFFileMetadata{}, fmt.Errorf("failed to copy file '%s': %w", filePath, err)
+	}
+
+	metadata.StartByte = s.currentPos
+	metadata.EndByte = s.currentPos + written
+	s.indexEntry(filePath, metadata)
+	s.currentPos = metadata.EndByte
+	return metadata, nil
+}
+
+// entriesByOffset returns the archive paths of index sorted by start byte, then path
+func entriesByOffset(files map[string]CAFFileMetadata) []string {
+	paths := make([]string, 0, len(files))
+	for filePath := range files {
+		paths = append(paths, filePath)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		a, b := files[paths[i]], files[paths[j]]
+		if a.StartByte != b.StartByte {
+			return a.StartByte < b.StartByte
+		}
+		return paths[i] < paths[j]
+	})
+	return paths
+}
+
+// RemoveFiles deletes entries from an archive and compacts it: the surviving
+// files are copied in index order into a new archive, which then atomically
+// replaces the original. Entries sharing a byte range keep sharing it.
+func (u *CAFUtils) RemoveFiles(archivePath string, paths []string) error {
+	deserializer := u.newDeserializer(archivePath)
+	defer func() { _ = deserializer.Close() }()
+	if err := deserializer.LoadIndex(); err != nil {
+		return err
+	}
+
+	remove := make(map[string]bool, len(paths))
+	for _, filePath := range paths {
+		if _, exists := deserializer.index.Files[filePath]; !exists {
+			return fmt.Errorf("%w: '%s'", ErrFileNotFound, filePath)
+		}
+		remove[filePath] = true
+	}
+
+	archiveInfo, err := os.Stat(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat archive file: %w", err)
+	}
+
+	// The serializer writes to a temp file and renames it over the original on Finalize
+	serializer, err := NewCAFSerializer(archivePath, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = serializer.Cleanup() }()
+	serializer.maxChunkSize = math.MaxInt64 // Compaction only ever shrinks the archive
+
+	// Keep the original's header version; legacy archives gain a header
+	if deserializer.version != 0 {
+		if err := serializer.rewriteHeader(deserializer.version); err != nil {
+			return err
+		}
+	}
+
+	copied := make(map[byteRange]CAFFileMetadata)
+	for _, filePath := range entriesByOffset(deserializer.index.Files) {
+		if remove[filePath] {
+			continue
+		}
+
+		metadata := deserializer.index.Files[filePath]
+		oldRange := byteRange{start: metadata.StartByte, end: metadata.EndByte}
+		if existing, ok := copied[oldRange]; ok {
+			metadata.StartByte = existing.StartByte
+			metadata.EndByte = existing.EndByte
+			serializer.indexEntry(filePath, metadata)
+			continue
+		}
+
+		section := io.NewSectionReader(deserializer.reader, metadata.StartByte, metadata.EndByte-metadata.StartByte)
+		newMetadata, err := serializer.addStoredEntry(filePath, section, metadata)
+		if err != nil {
+			return err
+		}
+		copied[oldRange] = newMetadata
+	}
+
+	// Release the original before it is replaced
+	if err := deserializer.Close(); err != nil {
+		return fmt.Errorf("failed to close archive: %w", err)
+	}
+	if _, err := serializer.Finalize(); err != nil {
+		return fmt.Errorf("failed to finalize compacted archive: %w", err)
+	}
+
+	// Keep the original's permissions
+	if err := os.Chmod(archivePath, archiveInfo.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to restore archive permissions: %w", err)
+	}
+
+	return nil
+}
+
+// Rename changes the archive paths of entries, given as a map from old to new
+// path. Only the index and footer are rewritten in place, so no file data is
+// copied. Renames apply simultaneously, so paths can be swapped; a new path that
+// collides with another entry is an error and leaves the archive unchanged.
+func (u *CAFUtils) Rename(archivePath string, renames map[string]string) error {
+	deserializer := u.newDeserializer(archivePath)
+	defer func() { _ = deserializer.Close() }()
+	if err := deserializer.LoadIndex(); err != nil {
+		return err
+	}
+
+	files := make(map[string]CAFFileMetadata, len(deserializer.index.Files))
+	for filePath, metadata := range deserializer.index.Files {
+		files[filePath] = metadata
+	}
+
+	for oldPath, newPath := range renames {
+		if _, exists := files[oldPath]; !exists {
+			return fmt.Errorf("%w: '%s'", ErrFileNotFound, oldPath)
+		}
+		if newPath == "" {
+			return fmt.Errorf("cannot rename '%s' to an empty path", oldPath)
+		}
+		delete(files, oldPath)
+	}
+
+	// Sorted so the reported collision does not depend on map order
+	oldPaths := make([]string, 0, len(renames))
+	for oldPath := range renames {
+		oldPaths = append(oldPaths, oldPath)
+	}
+	sort.Strings(oldPaths)
+
+	renamedFrom := make(map[string]string, len(renames))
+	for _, oldPath := range oldPaths {
+		newPath := renames[oldPath]
+		if other, exists := renamedFrom[newPath]; exists {
+			return fmt.Errorf("cannot rename both '%s' and '%s' to '%s'", other, oldPath, newPath)
+		}
+		if _, exists := files[newPath]; exists {
+			return fmt.Errorf("cannot rename '%s' to '%s': the archive already has that path", oldPath, newPath)
+		}
+		files[newPath] = deserializer.index.Files[oldPath]
+		renamedFrom[newPath] = oldPath
+	}
+
+	index := CAFIndex{FormatVersion: deserializer.index.FormatVersion, Files: files}
+	indexData, err := encodeIndex(index, deserializer.version)
+	if err != nil {
+		return err
+	}
+
+	// Release the read handle before rewriting the file
+	indexStart, version := deserializer.indexStart, deserializer.version
+	if err := deserializer.Close(); err != nil {
+		return fmt.Errorf("failed to close archive: %w", err)
+	}
+
+	file, err := os.OpenFile(archivePath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open archive file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	// Overwrite the old index and footer, then cut off whatever is left of them
+	trailer := indexData
+	if version != headerVersionIndexOffset {
+		trailer = binary.LittleEndian.AppendUint32(indexData, uint32(len(indexData)))
+	}
+	if _, err := file.WriteAt(trailer, indexStart); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := file.Truncate(indexStart + int64(len(trailer))); err != nil {
+		return fmt.Errorf("failed to truncate archive: %w", err)
+	}
+	if version == headerVersionIndexOffset {
+		if _, err := file.WriteAt(indexLocation(indexStart, int64(len(indexData))), headerSize); err != nil {
+			return fmt.Errorf("failed to write header: %w", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close archive: %w", err)
+	}
+	return nil
+}
+
+// defaultMergeSizeGB is the size limit of a merged archive when none is given
+const defaultMergeSizeGB = 30
+
+// MergeOptions controls how CAFUtils.MergeWithOptions combines archives
+type MergeOptions struct {
+	MaxChunkSizeGB int  // Size limit of the merged archive; 0 means 30 GB
+	LastWins       bool // Let later inputs replace files with the same path instead of failing
+}
+
+// Merge combines several archives into one with the default options: files
+// keep their archive paths and a path present in more than one input is an error
+func (u *CAFUtils) Merge(output string, inputs []string) error {
+	return u.MergeWithOptions(output, inputs, MergeOptions{})
+}
+
+// MergeWithOptions combines several archives into one, copying every file's
+// stored bytes verbatim so checksums, compression and attributes survive.
+// Entries sharing a byte range within an input keep sharing it.
+func (u *CAFUtils) MergeWithOptions(output string, inputs []string, opts MergeOptions) error {
+	if len(inputs) == 0 {
+		return fmt.Errorf("no input archives to merge")
+	}
+
+	maxSizeGB := opts.MaxChunkSizeGB
+	if maxSizeGB <= 0 {
+		maxSizeGB = defaultMergeSizeGB
+	}
+
+	// Load every index first so collisions are detected before anything is written
+	deserializers := make([]*CAFDeserializer, len(inputs))
+	defer func() {
+		for _, deserializer := range deserializers {
+			if deserializer != nil {
+				_ = deserializer.Close()
+			}
+		}
+	}()
+
+	owners := make(map[string]int)
+	for i, input := range inputs {
+		deserializer := u.newDeserializer(input)
+		deserializers[i] = deserializer
+		if err := deserializer.LoadIndex(); err != nil {
+			return fmt.Errorf("failed to load '%s': %w", input, err)
+		}
+
+		for filePath := range deserializer.index.Files {
+			if owner, exists := owners[filePath]; exists && !opts.LastWins {
+				return fmt.Errorf("file '%s' appears in both '%s' and '%s'", filePath, inputs[owner], input)
+			}
+			owners[filePath] = i
+		}
+	}
+
+	serializer, err := NewCAFSerializer(output, maxSizeGB)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = serializer.Cleanup() }()
+
+	for i, deserializer := range deserializers {
+		copied := make(map[byteRange]CAFFileMetadata)
+		for _, filePath := range entriesByOffset(deserializer.index.Files) {
+			if owners[filePath] != i {
+				continue // Replaced by a later input
+			}
+
+			metadata := deserializer.index.Files[filePath]
+			oldRange := byteRange{start: metadata.StartByte, end: metadata.EndByte}
+			if existing, ok := copied[oldRange]; ok {
+				metadata.StartByte = existing.StartByte
+				metadata.EndByte = existing.EndByte
+				serializer.indexEntry(filePath, metadata)
+				continue
+			}
+
+			section := io.NewSectionReader(deserializer.reader, metadata.StartByte, metadata.EndByte-metadata.StartByte)
+			newMetadata, err := serializer.addStoredEntry(filePath, section, metadata)
+			if err != nil {
+				return fmt.Errorf("failed to merge '%s': %w", inputs[i], err)
+			}
+			copied[oldRange] = newMetadata
+		}
+	}
+
+	if _, err := serializer.Finalize(); err != nil {
+		return fmt.Errorf("failed to finalize merged archive: %w", err)
+	}
+	return nil
+}
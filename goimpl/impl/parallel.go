@@ -0,0 +1,178 @@
+package caf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FileToArchive names a file on disk and the path to store it under in the archive
+type FileToArchive struct {
+	SourcePath  string // Path to the file on disk
+	ArchivePath string // Path to store in the archive
+}
+
+// parallelBufferLimit is the largest file AddFilesParallel reads into memory
+// ahead of writing; larger files are streamed when their turn comes. Compressed
+// files are always read whole, as AddFileCompressedFromPath does.
+const parallelBufferLimit = 64 * 1024 * 1024
+
+// preparedFile is a source file read, compressed and checksummed by a worker
+type preparedFile struct {
+	data        []byte
+	metadata    CAFFileMetadata
+	fileInfo    os.FileInfo
+	contentType string
+	stream      bool // Too large to buffer; the writer streams it from disk
+	err         error
+}
+
+// AddFilesParallel adds files from disk, reading and checksumming them in a pool
+// of workers while a single goroutine writes them in order. The archive is the
+// same as one built by adding the files one by one, whatever the worker count.
+// It returns the number of files added; fewer than len(files) means the next
+// file would exceed the size limit.
+func (s *CAFSerializer) AddFilesParallel(files []FileToArchive, workers int) (int, error) {
+	return s.addFilesParallel(context.Background(), files, workers, false)
+}
+
+// AddFilesParallelContext is AddFilesParallel, stopping with ctx.Err() once ctx
+// is cancelled. A cancelled serializer should be discarded.
+func (s *CAFSerializer) AddFilesParallelContext(ctx context.Context, files []FileToArchive, workers int) (int, error) {
+	return s.addFilesParallel(ctx, files, workers, false)
+}
+
+// AddFilesCompressedParallel is AddFilesParallel with every file gzipped by the
+// workers first, as AddFileCompressedFromPath does
+func (s *CAFSerializer) AddFilesCompressedParallel(files []FileToArchive, workers int) (int, error) {
+	return s.addFilesParallel(context.Background(), files, workers, true)
+}
+
+// AddFilesCompressedParallelContext is AddFilesCompressedParallel, stopping with
+// ctx.Err() once ctx is cancelled
+func (s *CAFSerializer) AddFilesCompressedParallelContext(ctx context.Context, files []FileToArchive, workers int) (int, error) {
+	return s.addFilesParallel(ctx, files, workers, true)
+}
+
+// addFilesParallel runs the worker pool behind AddFilesParallel and its variants
+func (s *CAFSerializer) addFilesParallel(ctx context.Context, files []FileToArchive, workers int, compress bool) (int, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// Each file gets its own slot, so workers never wait on the writer
+	results := make([]chan preparedFile, len(files))
+	for i := range results {
+		results[i] = make(chan preparedFile, 1)
+	}
+
+	jobs := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] <- s.prepareFile(ctx, files[i].SourcePath, files[i].ArchivePath, compress)
+			}
+		}()
+	}
+
+	// Bound how far the workers read ahead of the writer, and so the memory held
+	window := make(chan struct{}, 2*workers)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for i := range files {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for i, file := range files {
+		var prepared preparedFile
+		select {
+		case prepared = <-results[i]:
+		case <-ctx.Done():
+			return i, ctx.Err()
+		}
+		<-window
+
+		if prepared.err != nil {
+			return i, fmt.Errorf("failed to add file '%s': %w", file.SourcePath, prepared.err)
+		}
+
+		var (
+			added bool
+			err   error
+		)
+		if prepared.stream {
+			added, err = s.AddFileFromPathContext(ctx, file.ArchivePath, file.SourcePath)
+		} else {
+			added, err = s.writeSealed(file.ArchivePath, prepared.data, prepared.metadata)
+			if added {
+				s.recordFileInfo(file.ArchivePath, prepared.fileInfo, prepared.contentType)
+				size := prepared.metadata.OriginalSize
+				s.reportProgress(file.ArchivePath, size, size)
+			}
+		}
+		if err != nil {
+			return i, fmt.Errorf("failed to add file '%s': %w", file.SourcePath, err)
+		}
+		if !added {
+			return i, nil
+		}
+	}
+	return len(files), nil
+}
+
+// prepareFile reads a source file and gets its stored bytes ready for writing
+func (s *CAFSerializer) prepareFile(ctx context.Context, sourcePath, filePath string, compress bool) preparedFile {
+	if err := ctx.Err(); err != nil {
+		return preparedFile{err: err}
+	}
+
+	fileInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return preparedFile{err: fmt.Errorf("failed to stat source file: %w", err)}
+	}
+	if !compress && fileInfo.Size() > parallelBufferLimit {
+		return preparedFile{stream: true}
+	}
+
+	data, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return preparedFile{err: fmt.Errorf("failed to read source file: %w", err)}
+	}
+	contentType := detectContentType(filePath, data)
+
+	var metadata CAFFileMetadata
+	if compress {
+		data, metadata, err = compressData(data)
+		if err != nil {
+			return preparedFile{err: err}
+		}
+	}
+
+	data, metadata, err = s.sealData(data, metadata)
+	if err != nil {
+		return preparedFile{err: err}
+	}
+	return preparedFile{data: data, metadata: metadata, fileInfo: fileInfo, contentType: contentType}
+}
@@ -0,0 +1,73 @@
+package caf
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestParallelMatchesSequentialNearSizeLimit adds a file and its duplicate to an
+// archive with room for only one copy: with deduplication the duplicate costs no
+// space, so it must fit whether the files are added one by one or in parallel.
+func TestParallelMatchesSequentialNearSizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("duplicate content "), 64)
+	files := []FileToArchive{
+		{SourcePath: filepath.Join(dir, "a.txt"), ArchivePath: "a.txt"},
+		{SourcePath: filepath.Join(dir, "b.txt"), ArchivePath: "b.txt"},
+	}
+	for _, file := range files {
+		if err := os.WriteFile(file.SourcePath, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build := func(name string, add func(s *CAFSerializer) (int, error)) []byte {
+		t.Helper()
+		archivePath := filepath.Join(dir, name)
+		serializer, err := NewCAFSerializer(archivePath, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = serializer.Cleanup() }()
+		serializer.SetDeduplicate(true)
+		serializer.maxChunkSize = serializer.currentPos + int64(len(content)) + 1
+
+		added, err := add(serializer)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if added != len(files) {
+			t.Fatalf("%s: added %d of %d files", name, added, len(files))
+		}
+		if _, err := serializer.Finalize(); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(archivePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	sequential := build("sequential.caf", func(s *CAFSerializer) (int, error) {
+		for i, file := range files {
+			added, err := s.AddFileFromPath(file.ArchivePath, file.SourcePath)
+			if err != nil || !added {
+				return i, err
+			}
+		}
+		return len(files), nil
+	})
+
+	for _, workers := range []int{1, 4} {
+		parallel := build("parallel.caf", func(s *CAFSerializer) (int, error) {
+			return s.AddFilesParallel(files, workers)
+		})
+		if !bytes.Equal(parallel, sequential) {
+			t.Errorf("archive built with %d workers differs from the sequential one", workers)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package caf
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// spillRecord is one index entry as stored in a spill file
+type spillRecord struct {
+	Path     string          `json:"p"`
+	Metadata CAFFileMetadata `json:"m"`
+}
+
+// indexSpill keeps a serializer's index entries in a temporary side file rather
+// than in memory. Only each path and the number of its newest record stay in
+// memory; a path indexed again is superseded by its newer record.
+type indexSpill struct {
+	file    *os.File
+	writer  *bufio.Writer // Write errors are sticky and surface on the next flush
+	latest  map[string]int64
+	records int64
+	pending *spillRecord // Newest entry, held back so its attributes can still be filled in
+}
+
+// newIndexSpill creates an empty spill file in the temp directory
+func newIndexSpill() (*indexSpill, error) {
+	file, err := os.CreateTemp(os.TempDir(), fmt.Sprintf("caf_index_%d_*.tmp", os.Getpid()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create index spill file: %w", err)
+	}
+	return &indexSpill{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		latest: make(map[string]int64),
+	}, nil
+}
+
+// add indexes filePath, writing out the previously pending entry unless it is
+// the one being replaced
+func (sp *indexSpill) add(filePath string, metadata CAFFileMetadata) {
+	if sp.pending != nil && sp.pending.Path == filePath {
+		sp.pending.Metadata = metadata
+		return
+	}
+	sp.writePending()
+	sp.pending = &spillRecord{Path: filePath, Metadata: metadata}
+	sp.latest[filePath] = sp.records
+	sp.records++
+}
+
+// writePending appends the pending entry to the spill file
+func (sp *indexSpill) writePending() {
+	if sp.pending == nil {
+		return
+	}
+	line, err := json.Marshal(sp.pending)
+	if err == nil {
+		line = append(line, '\n')
+		_, _ = sp.writer.Write(line)
+	}
+	sp.pending = nil
+}
+
+// each calls fn with the newest entry of every path, in the order they were added
+func (sp *indexSpill) each(fn func(filePath string, metadata CAFFileMetadata) error) error {
+	sp.writePending()
+	if err := sp.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write index spill file: %w", err)
+	}
+
+	// Reading at an offset leaves the write position at the end of the file
+	decoder := json.NewDecoder(bufio.NewReader(io.NewSectionReader(sp.file, 0, 1<<63-1)))
+	for number := int64(0); ; number++ {
+		var record spillRecord
+		if err := decoder.Decode(&record); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read index spill file: %w", err)
+		}
+		if sp.latest[record.Path] != number {
+			continue // Superseded by a later record
+		}
+		if err := fn(record.Path, record.Metadata); err != nil {
+			return err
+		}
+	}
+}
+
+// close removes the spill file
+func (sp *indexSpill) close() error {
+	err := sp.file.Close()
+	if removeErr := os.Remove(sp.file.Name()); removeErr != nil && err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// SetSpillIndex chooses whether index entries are kept in a temporary side file
+// instead of memory until Finalize, which then streams them into the archive.
+// This bounds memory for archives with millions of files; only the paths stay
+// in memory. Entries already indexed are moved over, so it can be enabled on
+// an appender.
+func (s *CAFSerializer) SetSpillIndex(enabled bool) error {
+	if enabled == (s.spill != nil) {
+		return nil
+	}
+
+	if !enabled {
+		fileIndex := make(map[string]CAFFileMetadata, len(s.spill.latest))
+		err := s.spill.each(func(filePath string, metadata CAFFileMetadata) error {
+			fileIndex[filePath] = metadata
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.spill.close(); err != nil {
+			return fmt.Errorf("failed to remove index spill file: %w", err)
+		}
+		s.fileIndex = fileIndex
+		s.spill = nil
+		return nil
+	}
+
+	spill, err := newIndexSpill()
+	if err != nil {
+		return err
+	}
+	for _, filePath := range entriesByOffset(s.fileIndex) {
+		spill.add(filePath, s.fileIndex[filePath])
+	}
+	s.spill = spill
+	s.fileIndex = make(map[string]CAFFileMetadata)
+	return nil
+}
+
+// indexEntry records the index entry of filePath, replacing any earlier one
+func (s *CAFSerializer) indexEntry(filePath string, metadata CAFFileMetadata) {
+	if s.spill != nil {
+		s.spill.add(filePath, metadata)
+		return
+	}
+	s.fileIndex[filePath] = metadata
+}
+
+// lookupEntry returns the index entry of filePath. When spilling, only the most
+// recently indexed entry can be looked up.
+func (s *CAFSerializer) lookupEntry(filePath string) (CAFFileMetadata, bool) {
+	if s.spill != nil {
+		if s.spill.pending != nil && s.spill.pending.Path == filePath {
+			return s.spill.pending.Metadata, true
+		}
+		return CAFFileMetadata{}, false
+	}
+	metadata, exists := s.fileIndex[filePath]
+	return metadata, exists
+}
+
+// hasEntry reports whether filePath is in the index
+func (s *CAFSerializer) hasEntry(filePath string) bool {
+	if s.spill != nil {
+		_, exists := s.spill.latest[filePath]
+		return exists
+	}
+	_, exists := s.fileIndex[filePath]
+	return exists
+}
+
+// fileCount returns the number of files in the index
+func (s *CAFSerializer) fileCount() int {
+	if s.spill != nil {
+		return len(s.spill.latest)
+	}
+	return len(s.fileIndex)
+}
+
+// eachEntry calls fn with every index entry
+func (s *CAFSerializer) eachEntry(fn func(filePath string, metadata CAFFileMetadata) error) error {
+	if s.spill != nil {
+		return s.spill.each(fn)
+	}
+	for filePath, metadata := range s.fileIndex {
+		if err := fn(filePath, metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// writeSpilledIndex streams the spilled entries into the archive as an index
+// encoded for the serializer's header version, returning its size in bytes.
+// Keys keep the order files were added in rather than being sorted.
+func (s *CAFSerializer) writeSpilledIndex() (int64, error) {
+	counter := &countingWriter{writer: s.writer}
+
+	var (
+		out        io.Writer = counter
+		gzipWriter *gzip.Writer
+	)
+	if indexCompressed(s.version) {
+		gzipWriter = gzip.NewWriter(counter)
+		out = gzipWriter
+	}
+	buffered := bufio.NewWriter(out)
+
+	if _, err := buffered.WriteString(`{"format_version":"1.0","files":{`); err != nil {
+		return 0, fmt.Errorf("failed to write index: %w", err)
+	}
+
+	first := true
+	err := s.spill.each(func(filePath string, metadata CAFFileMetadata) error {
+		key, err := json.Marshal(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to marshal index: %w", err)
+		}
+		value, err := json.Marshal(metadata)
+		if err != nil {
+			return fmt.Errorf("failed to marshal index: %w", err)
+		}
+
+		if !first {
+			_ = buffered.WriteByte(',')
+		}
+		first = false
+		_, _ = buffered.Write(key)
+		_ = buffered.WriteByte(':')
+		if _, err := buffered.Write(value); err != nil {
+			return fmt.Errorf("failed to write index: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := buffered.WriteString("}}"); err != nil {
+		return 0, fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := buffered.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to write index: %w", err)
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			return 0, fmt.Errorf("failed to compress index: %w", err)
+		}
+	}
+	return counter.n, nil
+}
@@ -0,0 +1,62 @@
+package caf
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// spillBenchmarkEntries is the number of files added per archive in BenchmarkSpillIndex
+const spillBenchmarkEntries = 1_000_000
+
+// BenchmarkSpillIndex builds an archive of a million tiny files with the index
+// in memory and spilled to disk, reporting the heap still held by the
+// serializer once every file is added; that is what the index costs until Finalize.
+func BenchmarkSpillIndex(b *testing.B) {
+	paths := make([]string, spillBenchmarkEntries)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("dir%03d/file%07d.txt", i%1000, i)
+	}
+	data := []byte("x")
+
+	for _, spill := range []bool{false, true} {
+		name := "memory"
+		if spill {
+			name = "spill"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			var heapBytes uint64
+			for i := 0; i < b.N; i++ {
+				serializer, err := NewCAFSerializer(filepath.Join(b.TempDir(), "bench.caf"), 1)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := serializer.SetSpillIndex(spill); err != nil {
+					b.Fatal(err)
+				}
+
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				for _, filePath := range paths {
+					if _, err := serializer.AddFile(filePath, data); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				heapBytes += after.HeapAlloc - before.HeapAlloc
+
+				if _, err := serializer.Finalize(); err != nil {
+					b.Fatal(err)
+				}
+				_ = serializer.Cleanup()
+			}
+			b.ReportMetric(float64(heapBytes)/float64(b.N)/(1024*1024), "heap-MB/op")
+		})
+	}
+}
@@ -0,0 +1,532 @@
+package caf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// volumePath returns the path of the given 1-based volume of a multi-volume archive
+func volumePath(basePath string, volume int) string {
+	return fmt.Sprintf("%s.%03d", basePath, volume)
+}
+
+// stagingPath returns where a volume is kept until the whole archive is finalized
+func stagingPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".partial")
+}
+
+// CAFVolumeSerializer creates a multi-volume CAF archive, rolling over to a new
+// volume (archive.caf.001, archive.caf.002, ...) whenever the size limit is hit.
+// Completed volumes are staged under hidden names and only moved into place by
+// Finalize, so a failed run never replaces volumes of an existing archive.
+type CAFVolumeSerializer struct {
+	basePath       string
+	maxChunkSizeGB int
+	current        *CAFSerializer
+	volumes        []string
+	logger         *slog.Logger
+	deduplicate    bool
+	plainIndex     bool
+	headerIndex    bool
+	spillIndex     bool
+	overwrite      bool
+	progress       ProgressFunc
+	finished       map[string]bool // Paths stored in volumes already finalized
+	written        []string        // Staged volumes already completed, moved into place by Finalize
+	finalized      bool
+}
+
+// NewCAFVolumeSerializer creates a new multi-volume CAF serializer
+func NewCAFVolumeSerializer(basePath string, maxChunkSizeGB int) (*CAFVolumeSerializer, error) {
+	v := &CAFVolumeSerializer{
+		basePath:       basePath,
+		maxChunkSizeGB: maxChunkSizeGB,
+		logger:         discardLogger,
+		finished:       make(map[string]bool),
+	}
+	if err := v.nextVolume(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// SetLogger sets the logger used for diagnostic messages of every volume
+func (v *CAFVolumeSerializer) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = discardLogger
+	}
+	v.logger = logger
+	v.current.SetLogger(logger)
+}
+
+// SetDeduplicate enables or disables content deduplication. Since byte ranges
+// only make sense within one volume, duplicates are detected per volume.
+func (v *CAFVolumeSerializer) SetDeduplicate(enabled bool) {
+	v.deduplicate = enabled
+	v.current.SetDeduplicate(enabled)
+}
+
+// SetCompressIndex chooses whether every volume's index is gzipped (the default).
+// It must be called before any file is added.
+func (v *CAFVolumeSerializer) SetCompressIndex(enabled bool) error {
+	if err := v.current.SetCompressIndex(enabled); err != nil {
+		return err
+	}
+	v.plainIndex = !enabled
+	return nil
+}
+
+// SetHeaderIndexOffset chooses whether every volume records its index location
+// in the header instead of a footer. It must be called before any file is added.
+func (v *CAFVolumeSerializer) SetHeaderIndexOffset(enabled bool) error {
+	if err := v.current.SetHeaderIndexOffset(enabled); err != nil {
+		return err
+	}
+	v.headerIndex = enabled
+	return nil
+}
+
+// SetSpillIndex chooses whether every volume keeps its index entries in a
+// temporary side file instead of memory
+func (v *CAFVolumeSerializer) SetSpillIndex(enabled bool) error {
+	if err := v.current.SetSpillIndex(enabled); err != nil {
+		return err
+	}
+	v.spillIndex = enabled
+	return nil
+}
+
+// SetOverwrite chooses whether adding a path that is already in the archive
+// replaces its entry rather than failing with ErrDuplicatePath. Only entries in
+// the current volume can be replaced; a path stored in an earlier, finalized
+// volume is always an error.
+func (v *CAFVolumeSerializer) SetOverwrite(enabled bool) {
+	v.overwrite = enabled
+	v.current.SetOverwrite(enabled)
+}
+
+// SetProgress sets the progress callback of every volume
+func (v *CAFVolumeSerializer) SetProgress(progress ProgressFunc) {
+	v.progress = progress
+	v.current.SetProgress(progress)
+}
+
+// nextVolume starts writing the next volume of the archive
+func (v *CAFVolumeSerializer) nextVolume() error {
+	path := volumePath(v.basePath, len(v.volumes)+1)
+	serializer, err := NewCAFSerializer(stagingPath(path), v.maxChunkSizeGB)
+	if err != nil {
+		return fmt.Errorf("failed to create volume %d: %w", len(v.volumes)+1, err)
+	}
+	serializer.SetLogger(v.logger)
+	serializer.SetDeduplicate(v.deduplicate)
+	serializer.SetProgress(v.progress)
+	serializer.SetOverwrite(v.overwrite)
+	if v.plainIndex {
+		if err := serializer.SetCompressIndex(false); err != nil {
+			_ = serializer.Cleanup()
+			return err
+		}
+	}
+	if v.headerIndex {
+		if err := serializer.SetHeaderIndexOffset(true); err != nil {
+			_ = serializer.Cleanup()
+			return err
+		}
+	}
+	if v.spillIndex {
+		if err := serializer.SetSpillIndex(true); err != nil {
+			_ = serializer.Cleanup()
+			return err
+		}
+	}
+
+	v.current = serializer
+	v.volumes = append(v.volumes, path)
+	return nil
+}
+
+// add runs an add operation against the current volume, finalizing it and
+// retrying on a fresh volume if the file does not fit
+func (v *CAFVolumeSerializer) add(filePath string, addFn func(s *CAFSerializer) (bool, error)) error {
+	if v.finished[filePath] {
+		return fmt.Errorf("%w: '%s'", ErrDuplicatePath, filePath)
+	}
+
+	added, err := addFn(v.current)
+	if err != nil || added {
+		return err
+	}
+
+	if v.current.fileCount() == 0 {
+		return fmt.Errorf("file '%s' is larger than the %d GB volume size limit", filePath, v.maxChunkSizeGB)
+	}
+
+	// A replacement in the next volume would leave the old entry behind in this one
+	if v.current.hasEntry(filePath) {
+		return fmt.Errorf("%w: '%s' cannot be replaced once its volume is full", ErrDuplicatePath, filePath)
+	}
+
+	v.logger.Debug("CAF: volume full, rolling over", "volume", v.current.GetArchivePath())
+	err = v.current.eachEntry(func(filePath string, _ CAFFileMetadata) error {
+		v.finished[filePath] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	path, err := v.current.Finalize()
+	if err != nil {
+		return fmt.Errorf("failed to finalize volume: %w", err)
+	}
+	v.written = append(v.written, path)
+	if err := v.nextVolume(); err != nil {
+		return err
+	}
+
+	added, err = addFn(v.current)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return fmt.Errorf("file '%s' is larger than the %d GB volume size limit", filePath, v.maxChunkSizeGB)
+	}
+	return nil
+}
+
+// AddFile adds a file to the archive, starting a new volume if needed
+func (v *CAFVolumeSerializer) AddFile(filePath string, data []byte) error {
+	return v.add(filePath, func(s *CAFSerializer) (bool, error) {
+		return s.AddFile(filePath, data)
+	})
+}
+
+// AddFileCompressed gzips a file and adds it to the archive, starting a new volume if needed
+func (v *CAFVolumeSerializer) AddFileCompressed(filePath string, data []byte) error {
+	return v.add(filePath, func(s *CAFSerializer) (bool, error) {
+		return s.AddFileCompressed(filePath, data)
+	})
+}
+
+// AddFileFromReader adds a file from a reader, starting a new volume if needed.
+// The size limit is checked before any bytes are read, so a rejected attempt
+// leaves the reader untouched for the retry.
+func (v *CAFVolumeSerializer) AddFileFromReader(filePath string, reader io.Reader, contentLength int64) error {
+	return v.add(filePath, func(s *CAFSerializer) (bool, error) {
+		return s.AddFileFromReader(filePath, reader, contentLength)
+	})
+}
+
+// AddFileFromPath adds a file from the filesystem, starting a new volume if needed
+func (v *CAFVolumeSerializer) AddFileFromPath(filePath string, sourceFilePath string) error {
+	return v.add(filePath, func(s *CAFSerializer) (bool, error) {
+		return s.AddFileFromPath(filePath, sourceFilePath)
+	})
+}
+
+// AddFileCompressedFromPath gzips a file from the filesystem and adds it, starting a new volume if needed
+func (v *CAFVolumeSerializer) AddFileCompressedFromPath(filePath string, sourceFilePath string) error {
+	return v.add(filePath, func(s *CAFSerializer) (bool, error) {
+		return s.AddFileCompressedFromPath(filePath, sourceFilePath)
+	})
+}
+
+// Finalize completes the last volume and returns the paths of all volumes.
+// An archive that fits in a single volume is renamed to the base path.
+func (v *CAFVolumeSerializer) Finalize() ([]string, error) {
+	path, err := v.current.Finalize()
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize volume: %w", err)
+	}
+	v.written = append(v.written, path)
+
+	if len(v.volumes) == 1 {
+		v.volumes[0] = v.basePath
+	}
+
+	// Move the staged volumes into place; any left over are removed by Cleanup
+	for i := 0; len(v.written) > 0; i++ {
+		if err := os.Rename(v.written[0], v.volumes[i]); err != nil {
+			return nil, fmt.Errorf("failed to move volume into place: %w", err)
+		}
+		v.written = v.written[1:]
+	}
+
+	v.finalized = true
+	return v.volumes, nil
+}
+
+// Cleanup frees resources used by the current volume. Unless Finalize succeeded,
+// it also removes the staged volumes already completed, so a failed run leaves
+// nothing behind.
+func (v *CAFVolumeSerializer) Cleanup() error {
+	err := v.current.Cleanup()
+	if v.finalized {
+		return err
+	}
+	for _, path := range v.written {
+		if removeErr := os.Remove(path); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = removeErr
+		}
+	}
+	v.written = nil
+	return err
+}
+
+// GetVolumeCount returns the number of volumes started so far
+func (v *CAFVolumeSerializer) GetVolumeCount() int {
+	return len(v.volumes)
+}
+
+// FindVolumes returns the volumes of a multi-volume archive in order. If basePath
+// itself exists it is treated as a single-volume archive.
+func FindVolumes(basePath string) ([]string, error) {
+	if _, err := os.Stat(basePath); err == nil {
+		return []string{basePath}, nil
+	}
+
+	matches, err := filepath.Glob(basePath + ".[0-9][0-9][0-9]")
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for volumes: %w", err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no CAF archive or volumes found for '%s'", basePath)
+	}
+
+	sort.Strings(matches)
+	for i, match := range matches {
+		if match != volumePath(basePath, i+1) {
+			return nil, fmt.Errorf("volume %d of '%s' is missing", i+1, basePath)
+		}
+	}
+	return matches, nil
+}
+
+// GetVolumeStats gets the statistics of a multi-volume archive, summed over its
+// volumes; sizes count every volume's file, and Files is sorted by path
+func (u *CAFUtils) GetVolumeStats(volumePaths []string) (*ArchiveStats, error) {
+	if len(volumePaths) == 0 {
+		return nil, fmt.Errorf("no volumes given")
+	}
+
+	total := &ArchiveStats{Files: make([]FileInfo, 0)}
+	for i, path := range volumePaths {
+		stats, err := u.GetArchiveStats(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read volume '%s': %w", path, err)
+		}
+		if i == 0 {
+			total.FormatVersion = stats.FormatVersion
+		}
+		total.TotalFiles += stats.TotalFiles
+		total.TotalSize += stats.TotalSize
+		total.DataSize += stats.DataSize
+		total.OverheadSize += stats.OverheadSize
+		total.ContentSize += stats.ContentSize
+		total.Files = append(total.Files, stats.Files...)
+	}
+
+	sort.Slice(total.Files, func(i, j int) bool { return total.Files[i].Path < total.Files[j].Path })
+	return total, nil
+}
+
+// CAFVolumeSet reads a multi-volume CAF archive as a single unified archive
+type CAFVolumeSet struct {
+	volumes     []*CAFDeserializer
+	fileVolumes map[string]*CAFDeserializer
+}
+
+// NewCAFVolumeSet creates a reader over the given volumes
+func NewCAFVolumeSet(volumePaths []string) *CAFVolumeSet {
+	volumes := make([]*CAFDeserializer, len(volumePaths))
+	for i, path := range volumePaths {
+		volumes[i] = NewCAFDeserializer(path)
+	}
+	return &CAFVolumeSet{volumes: volumes}
+}
+
+// SetAllowLegacy controls whether volumes without the magic header can be loaded
+func (v *CAFVolumeSet) SetAllowLegacy(allow bool) {
+	for _, volume := range v.volumes {
+		volume.SetAllowLegacy(allow)
+	}
+}
+
+// SetProgress sets the extraction progress callback of every volume
+func (v *CAFVolumeSet) SetProgress(progress ProgressFunc) {
+	for _, volume := range v.volumes {
+		volume.SetProgress(progress)
+	}
+}
+
+// Close releases the archive files of every volume
+func (v *CAFVolumeSet) Close() error {
+	var err error
+	for _, volume := range v.volumes {
+		if closeErr := volume.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// LoadIndex loads the index of every volume and merges them
+func (v *CAFVolumeSet) LoadIndex() error {
+	fileVolumes := make(map[string]*CAFDeserializer)
+	for _, volume := range v.volumes {
+		if err := volume.LoadIndex(); err != nil {
+			if len(v.volumes) == 1 {
+				return err // A single-file archive, not one volume of many
+			}
+			return fmt.Errorf("failed to load volume '%s': %w", volume.archivePath, err)
+		}
+
+		for filePath := range volume.index.Files {
+			if existing, ok := fileVolumes[filePath]; ok {
+				return fmt.Errorf("file '%s' appears in both '%s' and '%s'", filePath, existing.archivePath, volume.archivePath)
+			}
+			fileVolumes[filePath] = volume
+		}
+	}
+
+	v.fileVolumes = fileVolumes
+	return nil
+}
+
+// volumeFor returns the volume holding the given file
+func (v *CAFVolumeSet) volumeFor(filePath string) (*CAFDeserializer, error) {
+	if v.fileVolumes == nil {
+		return nil, fmt.Errorf("index not loaded, call LoadIndex() first")
+	}
+	volume, exists := v.fileVolumes[filePath]
+	if !exists {
+		return nil, fmt.Errorf("%w: '%s'", ErrFileNotFound, filePath)
+	}
+	return volume, nil
+}
+
+// GetVolumes returns the deserializers for each volume in order
+func (v *CAFVolumeSet) GetVolumes() []*CAFDeserializer {
+	return v.volumes
+}
+
+// GetFileList returns all files across every volume, sorted by path
+func (v *CAFVolumeSet) GetFileList() ([]string, error) {
+	if v.fileVolumes == nil {
+		return nil, fmt.Errorf("index not loaded, call LoadIndex() first")
+	}
+
+	files := make([]string, 0, len(v.fileVolumes))
+	for filePath := range v.fileVolumes {
+		files = append(files, filePath)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// MatchFiles returns the paths across every volume matching pattern, sorted by
+// path; see CAFDeserializer.MatchFiles
+func (v *CAFVolumeSet) MatchFiles(pattern string) ([]string, error) {
+	files, err := v.GetFileList()
+	if err != nil {
+		return nil, err
+	}
+	return matchPaths(files, pattern)
+}
+
+// GetFormatVersion returns the format version of the first volume; every volume
+// of a set is written with the same one
+func (v *CAFVolumeSet) GetFormatVersion() (string, error) {
+	if v.fileVolumes == nil {
+		return "", fmt.Errorf("index not loaded, call LoadIndex() first")
+	}
+	return v.volumes[0].GetFormatVersion()
+}
+
+// HasFile checks if a file exists in any volume
+func (v *CAFVolumeSet) HasFile(filePath string) (bool, error) {
+	if v.fileVolumes == nil {
+		return false, fmt.Errorf("index not loaded, call LoadIndex() first")
+	}
+	_, exists := v.fileVolumes[filePath]
+	return exists, nil
+}
+
+// GetFileMetadata gets metadata for a specific file from the volume holding it
+func (v *CAFVolumeSet) GetFileMetadata(filePath string) (*CAFFileMetadata, error) {
+	volume, err := v.volumeFor(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return volume.GetFileMetadata(filePath)
+}
+
+// ExtractFile extracts a specific file from whichever volume holds it
+func (v *CAFVolumeSet) ExtractFile(filePath string) ([]byte, error) {
+	volume, err := v.volumeFor(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return volume.ExtractFile(filePath)
+}
+
+// ExtractFileToPath extracts a file from whichever volume holds it and saves it to the filesystem
+func (v *CAFVolumeSet) ExtractFileToPath(filePath string, outputPath string) error {
+	volume, err := v.volumeFor(filePath)
+	if err != nil {
+		return err
+	}
+	return volume.ExtractFileToPath(filePath, outputPath)
+}
+
+// ExtractFilesConcurrentContext extracts the given paths to a directory volume by
+// volume, using the given number of workers per volume. Every path is checked
+// before anything is written; see CAFDeserializer.ExtractFilesConcurrentContext.
+func (v *CAFVolumeSet) ExtractFilesConcurrentContext(ctx context.Context, outputDir string, files []string, workers int) error {
+	byVolume := make(map[*CAFDeserializer][]string)
+	for _, filePath := range files {
+		volume, err := v.volumeFor(filePath)
+		if err != nil {
+			return err
+		}
+		if _, err := safeJoin(outputDir, filePath); err != nil {
+			return err
+		}
+		byVolume[volume] = append(byVolume[volume], filePath)
+	}
+
+	for _, volume := range v.volumes {
+		if len(byVolume[volume]) == 0 {
+			continue
+		}
+		if err := volume.ExtractFilesConcurrentContext(ctx, outputDir, byVolume[volume], workers); err != nil {
+			return fmt.Errorf("failed to extract volume '%s': %w", volume.archivePath, err)
+		}
+	}
+	return nil
+}
+
+// ExtractAll extracts the files of every volume to a directory
+func (v *CAFVolumeSet) ExtractAll(outputDir string) error {
+	return v.ExtractAllConcurrent(outputDir, 1)
+}
+
+// ExtractAllConcurrent extracts the files of every volume to a directory using
+// the given number of workers per volume
+func (v *CAFVolumeSet) ExtractAllConcurrent(outputDir string, workers int) error {
+	if v.fileVolumes == nil {
+		return fmt.Errorf("index not loaded, call LoadIndex() first")
+	}
+
+	for _, volume := range v.volumes {
+		if err := volume.ExtractAllConcurrent(outputDir, workers); err != nil {
+			return fmt.Errorf("failed to extract volume '%s': %w", volume.archivePath, err)
+		}
+	}
+	return nil
+}
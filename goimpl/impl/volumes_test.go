@@ -0,0 +1,117 @@
+package caf
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFailedVolumeRunKeepsExistingArchive rolls a volume set over and then
+// fails it: the volumes of the archive already at the base path must survive
+// untouched, and no staged volume may be left behind.
+func TestFailedVolumeRunKeepsExistingArchive(t *testing.T) {
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "archive.caf")
+	old := map[string][]byte{
+		basePath:                []byte("old single archive"),
+		volumePath(basePath, 1): []byte("old volume 1"),
+		volumePath(basePath, 2): []byte("old volume 2"),
+	}
+	for path, data := range old {
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serializer, err := NewCAFVolumeSerializer(basePath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serializer.current.maxChunkSize = serializer.current.currentPos + 10
+
+	if err := serializer.AddFile("a.txt", []byte("aaaaaaaa")); err != nil {
+		t.Fatal(err)
+	}
+	if err := serializer.AddFile("b.txt", []byte("bbbbbbbb")); err != nil {
+		t.Fatal(err)
+	}
+	if serializer.GetVolumeCount() != 2 {
+		t.Fatalf("expected a rollover to a second volume, have %d", serializer.GetVolumeCount())
+	}
+	if err := serializer.AddFile("a.txt", []byte("again")); !errors.Is(err, ErrDuplicatePath) {
+		t.Fatalf("expected ErrDuplicatePath, got %v", err)
+	}
+	if err := serializer.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, data := range old {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("'%s' was modified by the failed run", path)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(old) {
+		for _, entry := range entries {
+			t.Log(entry.Name())
+		}
+		t.Errorf("expected only the %d old files to remain, found %d", len(old), len(entries))
+	}
+}
+
+// TestFinalizeMovesVolumesIntoPlace checks that a completed volume set ends up
+// under the numbered names, readable as one archive
+func TestFinalizeMovesVolumesIntoPlace(t *testing.T) {
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "archive.caf")
+
+	serializer, err := NewCAFVolumeSerializer(basePath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = serializer.Cleanup() }()
+	serializer.current.maxChunkSize = serializer.current.currentPos + 10
+
+	files := map[string][]byte{"a.txt": []byte("aaaaaaaa"), "b.txt": []byte("bbbbbbbb")}
+	for _, path := range []string{"a.txt", "b.txt"} {
+		if err := serializer.AddFile(path, files[path]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	volumes, err := serializer.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := FindVolumes(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || len(volumes) != 2 || found[0] != volumes[0] || found[1] != volumes[1] {
+		t.Fatalf("expected volumes %v, found %v", volumes, found)
+	}
+
+	set := NewCAFVolumeSet(found)
+	defer func() { _ = set.Close() }()
+	if err := set.LoadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range files {
+		got, err := set.ExtractFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("'%s' extracted as %q", path, got)
+		}
+	}
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
 
 	caf "cafcli/impl"
 
@@ -18,10 +27,12 @@ var (
 	date    = "unknown"
 )
 
-// FileToArchive represents a file to be added to the archive
-type FileToArchive struct {
-	SourcePath  string // Path to the file on disk
-	ArchivePath string // Path to store in the archive
+// ListOutput is the JSON document printed by `list --json`
+type ListOutput struct {
+	Archive       string         `json:"archive"`
+	FormatVersion string         `json:"format_version"`
+	TotalFiles    int            `json:"total_files"`
+	Files         []caf.FileInfo `json:"files"`
 }
 
 var rootCmd = &cobra.Command{
@@ -35,34 +46,56 @@ CAF is designed for efficient storage of multiple files in single chunks with fa
 var listCmd = &cobra.Command{
 	Use:   "list <caf-file>",
 	Short: "List all files in a CAF archive",
-	Long:  `Lists all files contained in the specified CAF archive along with their sizes.`,
-	Args:  cobra.ExactArgs(1),
+	Long: `Lists all files contained in the specified CAF archive along with their sizes.
+With --json, the listing is printed as a JSON document instead of a table.`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cafFile := args[0]
 
-		// Check if file exists
-		if _, err := os.Stat(cafFile); os.IsNotExist(err) {
-			return fmt.Errorf("CAF file does not exist: %s", cafFile)
-		}
-
-		// Create deserializer and load index
-		deserializer := caf.NewCAFDeserializer(cafFile)
-		if err := deserializer.LoadIndex(); err != nil {
-			return fmt.Errorf("failed to load CAF index: %w", err)
+		archive, err := openArchive(cmd, cafFile)
+		if err != nil {
+			return err
 		}
+		defer func() { _ = archive.Close() }()
 
 		// Get file list
-		files, err := deserializer.GetFileList()
+		files, err := archive.GetFileList()
 		if err != nil {
 			return fmt.Errorf("failed to get file list: %w", err)
 		}
 
 		// Get format version
-		version, err := deserializer.GetFormatVersion()
+		version, err := archive.GetFormatVersion()
 		if err != nil {
 			return fmt.Errorf("failed to get format version: %w", err)
 		}
 
+		// Collect file sizes
+		entries := make([]caf.FileInfo, 0, len(files))
+		for _, filePath := range files {
+			metadata, err := archive.GetFileMetadata(filePath)
+			if err != nil {
+				return fmt.Errorf("failed to get metadata for file %s: %w", filePath, err)
+			}
+
+			entries = append(entries, caf.FileInfo{
+				Path:        filePath,
+				Size:        metadata.Size(),
+				StoredSize:  metadata.StoredSize(),
+				ContentType: metadata.ContentType,
+			})
+		}
+
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		if jsonOutput {
+			return printJSON(ListOutput{
+				Archive:       cafFile,
+				FormatVersion: version,
+				TotalFiles:    len(entries),
+				Files:         entries,
+			})
+		}
+
 		// Print archive info
 		fmt.Printf("CAF Archive: %s\n", cafFile)
 		fmt.Printf("Format Version: %s\n", version)
@@ -72,14 +105,8 @@ var listCmd = &cobra.Command{
 		fmt.Printf("%-50s %12s\n", "File Path", "Size (bytes)")
 		fmt.Printf("%s\n", strings.Repeat("-", 65))
 
-		for _, filePath := range files {
-			metadata, err := deserializer.GetFileMetadata(filePath)
-			if err != nil {
-				return fmt.Errorf("failed to get metadata for file %s: %w", filePath, err)
-			}
-
-			size := metadata.EndByte - metadata.StartByte
-			fmt.Printf("%-50s %12d\n", filePath, size)
+		for _, entry := range entries {
+			fmt.Printf("%-50s %12d\n", entry.Path, entry.Size)
 		}
 
 		return nil
@@ -94,11 +121,6 @@ var splitCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cafFile := args[0]
 
-		// Check if file exists
-		if _, err := os.Stat(cafFile); os.IsNotExist(err) {
-			return fmt.Errorf("CAF file does not exist: %s", cafFile)
-		}
-
 		// Create output directory
 		outputDir := "extracted_files"
 		customDir, _ := cmd.Flags().GetString("output")
@@ -106,24 +128,46 @@ var splitCmd = &cobra.Command{
 			outputDir = customDir
 		}
 
-		// Create deserializer and load index
-		deserializer := caf.NewCAFDeserializer(cafFile)
-		if err := deserializer.LoadIndex(); err != nil {
-			return fmt.Errorf("failed to load CAF index: %w", err)
+		archive, err := openArchive(cmd, cafFile)
+		if err != nil {
+			return err
 		}
+		defer func() { _ = archive.Close() }()
 
-		// Get file list for progress reporting
-		files, err := deserializer.GetFileList()
+		// Get file list for progress reporting, narrowed by --filter if given
+		files, err := archive.GetFileList()
 		if err != nil {
 			return fmt.Errorf("failed to get file list: %w", err)
 		}
 
+		filter, _ := cmd.Flags().GetString("filter")
+		if filter != "" {
+			files, err = archive.MatchFiles(filter)
+			if err != nil {
+				return err
+			}
+			if len(files) == 0 {
+				return fmt.Errorf("no files in %s match filter '%s'", cafFile, filter)
+			}
+		}
+
+		jobs, _ := cmd.Flags().GetInt("jobs")
+		showProgress, _ := cmd.Flags().GetBool("progress")
+
 		fmt.Printf("Extracting %d files from %s to %s...\n", len(files), cafFile, outputDir)
 
-		// Extract all files
-		if err := deserializer.ExtractAll(outputDir); err != nil {
+		var meter *progressMeter
+		if showProgress {
+			meter = newProgressMeter(len(files))
+			archive.SetProgress(meter.update)
+			defer meter.finish()
+		}
+
+		// Extract the selected files
+		if err := archive.ExtractFilesConcurrentContext(cmd.Context(), outputDir, files, jobs); err != nil {
 			return fmt.Errorf("failed to extract files: %w", err)
 		}
+		meter.finish()
 
 		fmt.Printf("Successfully extracted %d files to %s\n", len(files), outputDir)
 		return nil
@@ -140,37 +184,25 @@ var extractCmd = &cobra.Command{
 		filePath := args[1]
 		outputPath := args[2]
 
-		// Check if CAF file exists
-		if _, err := os.Stat(cafFile); os.IsNotExist(err) {
-			return fmt.Errorf("CAF file does not exist: %s", cafFile)
-		}
-
-		// Create deserializer and load index
-		deserializer := caf.NewCAFDeserializer(cafFile)
-		if err := deserializer.LoadIndex(); err != nil {
-			return fmt.Errorf("failed to load CAF index: %w", err)
-		}
-
-		// Check if file exists in archive
-		hasFile, err := deserializer.HasFile(filePath)
+		archive, err := openArchive(cmd, cafFile)
 		if err != nil {
-			return fmt.Errorf("failed to check file existence: %w", err)
-		}
-		if !hasFile {
-			return fmt.Errorf("file '%s' not found in archive", filePath)
+			return err
 		}
+		defer func() { _ = archive.Close() }()
 
 		// Get file metadata for size info
-		metadata, err := deserializer.GetFileMetadata(filePath)
+		metadata, err := archive.GetFileMetadata(filePath)
+		if errors.Is(err, caf.ErrFileNotFound) {
+			return fmt.Errorf("file '%s' not found in archive", filePath)
+		}
 		if err != nil {
 			return fmt.Errorf("failed to get file metadata: %w", err)
 		}
 
-		fileSize := metadata.EndByte - metadata.StartByte
-		fmt.Printf("Extracting file '%s' (%d bytes) to '%s'...\n", filePath, fileSize, outputPath)
+		fmt.Printf("Extracting file '%s' (%d bytes) to '%s'...\n", filePath, metadata.Size(), outputPath)
 
 		// Extract the file
-		if err := deserializer.ExtractFileToPath(filePath, outputPath); err != nil {
+		if err := archive.ExtractFileToPath(filePath, outputPath); err != nil {
 			return fmt.Errorf("failed to extract file: %w", err)
 		}
 
@@ -180,10 +212,14 @@ var extractCmd = &cobra.Command{
 }
 
 var validateCmd = &cobra.Command{
-	Use:   "validate <caf-file>",
-	Short: "Validate a CAF archive",
-	Long:  `Validates the structure and integrity of a CAF archive file.`,
-	Args:  cobra.ExactArgs(1),
+	Use:     "validate <caf-file>",
+	Aliases: []string{"verify"},
+	Short:   "Validate a CAF archive",
+	Long: `Validates the structure and integrity of a CAF archive file.
+With --checksums, every file is re-read and compared against its stored checksum.
+With --deep, every index entry is cross-checked against the archive layout and
+each problem found (out-of-bounds, overlapping or unreferenced ranges) is listed.`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cafFile := args[0]
 
@@ -192,10 +228,43 @@ var validateCmd = &cobra.Command{
 			return fmt.Errorf("CAF file does not exist: %s", cafFile)
 		}
 
-		utils := &caf.CAFUtils{}
-		isValid, err := utils.ValidateArchive(cafFile)
-		if err != nil {
-			return fmt.Errorf("validation failed: %w", err)
+		verifyChecksums, _ := cmd.Flags().GetBool("checksums")
+		deep, _ := cmd.Flags().GetBool("deep")
+
+		legacy, _ := cmd.Flags().GetBool("legacy")
+		utils := &caf.CAFUtils{AllowLegacy: legacy}
+		isValid := true
+
+		// Check the layout first, so checksums are only read from sane byte ranges
+		if deep {
+			issues, err := utils.DeepValidate(cafFile)
+			if err != nil && !errors.Is(err, caf.ErrNotCAFArchive) {
+				return fmt.Errorf("validation failed: %w", err)
+			}
+
+			problems := 0
+			for _, issue := range issues {
+				description := issue.Description
+				if issue.Warning {
+					description = "warning: " + description
+				} else {
+					problems++
+				}
+				if issue.Path != "" {
+					fmt.Printf("  %s: %s\n", issue.Path, description)
+				} else {
+					fmt.Printf("  %s\n", description)
+				}
+			}
+			isValid = err == nil && problems == 0
+		}
+
+		if isValid {
+			var err error
+			isValid, err = utils.ValidateArchive(cafFile, verifyChecksums)
+			if err != nil {
+				return fmt.Errorf("validation failed: %w", err)
+			}
 		}
 
 		if isValid {
@@ -211,34 +280,44 @@ var validateCmd = &cobra.Command{
 var statsCmd = &cobra.Command{
 	Use:   "stats <caf-file>",
 	Short: "Show statistics about a CAF archive",
-	Long:  `Displays detailed statistics about a CAF archive including total size, file count, and file details.`,
-	Args:  cobra.ExactArgs(1),
+	Long: `Displays detailed statistics about a CAF archive including total size, file count, and file details.
+With --json, the statistics are printed as a JSON document instead.`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cafFile := args[0]
 
-		// Check if file exists
-		if _, err := os.Stat(cafFile); os.IsNotExist(err) {
-			return fmt.Errorf("CAF file does not exist: %s", cafFile)
+		// A multi-volume archive is summed over its volumes
+		volumes, err := caf.FindVolumes(cafFile)
+		if err != nil {
+			return err
 		}
 
-		utils := &caf.CAFUtils{}
-		stats, err := utils.GetArchiveStats(cafFile)
+		legacy, _ := cmd.Flags().GetBool("legacy")
+		utils := &caf.CAFUtils{AllowLegacy: legacy}
+		stats, err := utils.GetVolumeStats(volumes)
 		if err != nil {
 			return fmt.Errorf("failed to get archive statistics: %w", err)
 		}
 
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		if jsonOutput {
+			return printJSON(stats)
+		}
+
 		fmt.Printf("CAF Archive Statistics: %s\n", cafFile)
 		fmt.Printf("Format Version: %s\n", stats.FormatVersion)
 		fmt.Printf("Total Files: %d\n", stats.TotalFiles)
-		fmt.Printf("Total Size: %d bytes (%.2f MB)\n", stats.TotalSize, float64(stats.TotalSize)/(1024*1024))
+		fmt.Printf("Archive Size: %d bytes (%.2f MB)\n", stats.TotalSize, float64(stats.TotalSize)/(1024*1024))
+		fmt.Printf("  File Data: %d bytes\n", stats.DataSize)
+		fmt.Printf("  Header, Index and Footer: %d bytes\n", stats.OverheadSize)
+		fmt.Printf("Content Size: %d bytes (%.2f MB)\n", stats.ContentSize, float64(stats.ContentSize)/(1024*1024))
+		if stats.ContentSize > 0 {
+			fmt.Printf("Storage Ratio: %.1f%% (file data / content)\n", float64(stats.DataSize)/float64(stats.ContentSize)*100)
+		}
 
-		// Calculate average file size
+		// Average of the logical file sizes
 		if stats.TotalFiles > 0 {
-			totalContentSize := int64(0)
-			for _, file := range stats.Files {
-				totalContentSize += file.Size
-			}
-			avgSize := totalContentSize / int64(stats.TotalFiles)
+			avgSize := stats.ContentSize / int64(stats.TotalFiles)
 			fmt.Printf("Average File Size: %d bytes (%.2f KB)\n", avgSize, float64(avgSize)/1024)
 		}
 
@@ -246,11 +325,11 @@ var statsCmd = &cobra.Command{
 		verbose, _ := cmd.Flags().GetBool("verbose")
 		if verbose {
 			fmt.Printf("\nFile Details:\n")
-			fmt.Printf("%-50s %12s\n", "File Path", "Size (bytes)")
-			fmt.Printf("%s\n", strings.Repeat("-", 65))
+			fmt.Printf("%-50s %12s %12s\n", "File Path", "Size (bytes)", "Stored")
+			fmt.Printf("%s\n", strings.Repeat("-", 78))
 
 			for _, file := range stats.Files {
-				fmt.Printf("%-50s %12d\n", file.Path, file.Size)
+				fmt.Printf("%-50s %12d %12d\n", file.Path, file.Size, file.StoredSize)
 			}
 		}
 
@@ -263,7 +342,7 @@ var createCmd = &cobra.Command{
 	Short: "Create a CAF archive from files and directories",
 	Long: `Creates a new CAF archive from the specified files and directories.
 Files are added to the archive preserving their relative paths.
-Directories are scanned one level deep for files.`,
+Directories are scanned one level deep for files unless --recursive is set.`,
 	Args: cobra.MinimumNArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		outputPath := args[0]
@@ -273,6 +352,28 @@ Directories are scanned one level deep for files.`,
 		maxSizeGB, _ := cmd.Flags().GetInt("max-size")
 		verbose, _ := cmd.Flags().GetBool("verbose")
 		baseDir, _ := cmd.Flags().GetString("base-dir")
+		recursive, _ := cmd.Flags().GetBool("recursive")
+		compress, _ := cmd.Flags().GetBool("compress")
+		multiVolume, _ := cmd.Flags().GetBool("multi-volume")
+		dedup, _ := cmd.Flags().GetBool("dedup")
+		force, _ := cmd.Flags().GetBool("force")
+		showProgress, _ := cmd.Flags().GetBool("progress")
+		plainIndex, _ := cmd.Flags().GetBool("plain-index")
+		headerIndex, _ := cmd.Flags().GetBool("header-index")
+		jobs, _ := cmd.Flags().GetInt("jobs")
+
+		if headerIndex && plainIndex {
+			return fmt.Errorf("--header-index cannot be combined with --plain-index")
+		}
+
+		if jobs > 1 && multiVolume {
+			return fmt.Errorf("--jobs cannot be combined with --multi-volume")
+		}
+
+		// Refuse to clobber an existing archive (or volume set) unless forced
+		if existing, err := caf.FindVolumes(outputPath); err == nil && !force {
+			return fmt.Errorf("output '%s' already exists, use --force to overwrite it", existing[0])
+		}
 
 		if verbose {
 			fmt.Printf("Creating CAF archive: %s\n", outputPath)
@@ -283,7 +384,7 @@ Directories are scanned one level deep for files.`,
 		}
 
 		// Collect all files to archive
-		filesToArchive, err := collectFiles(inputPaths, baseDir, verbose)
+		filesToArchive, err := collectFiles(inputPaths, baseDir, recursive, verbose)
 		if err != nil {
 			return fmt.Errorf("failed to collect files: %w", err)
 		}
@@ -296,6 +397,16 @@ Directories are scanned one level deep for files.`,
 			fmt.Printf("Found %d files to archive\n", len(filesToArchive))
 		}
 
+		var meter *progressMeter
+		if showProgress {
+			meter = newProgressMeter(len(filesToArchive))
+			defer meter.finish()
+		}
+
+		if multiVolume {
+			return createVolumes(cmd.Context(), outputPath, filesToArchive, maxSizeGB, compress, dedup, plainIndex, headerIndex, force, verbose, meter)
+		}
+
 		// Create serializer
 		serializer, err := caf.NewCAFSerializer(outputPath, maxSizeGB)
 		if err != nil {
@@ -303,35 +414,85 @@ Directories are scanned one level deep for files.`,
 		}
 		defer func() { _ = serializer.Cleanup() }()
 
+		serializer.SetDeduplicate(dedup)
+		if plainIndex {
+			if err := serializer.SetCompressIndex(false); err != nil {
+				return err
+			}
+		}
+		if headerIndex {
+			if err := serializer.SetHeaderIndexOffset(true); err != nil {
+				return err
+			}
+		}
+		if verbose {
+			serializer.SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+		}
+		if meter != nil {
+			serializer.SetProgress(meter.update)
+		}
+
 		// Add files to archive
 		filesAdded := 0
-		for _, fileInfo := range filesToArchive {
+		if jobs > 1 {
 			if verbose {
-				fmt.Printf("Adding: %s -> %s\n", fileInfo.SourcePath, fileInfo.ArchivePath)
+				fmt.Printf("Adding %d files with %d workers\n", len(filesToArchive), jobs)
+			}
+			if compress {
+				filesAdded, err = serializer.AddFilesCompressedParallelContext(cmd.Context(), filesToArchive, jobs)
+			} else {
+				filesAdded, err = serializer.AddFilesParallelContext(cmd.Context(), filesToArchive, jobs)
 			}
-
-			added, err := serializer.AddFileFromPath(fileInfo.ArchivePath, fileInfo.SourcePath)
 			if err != nil {
-				return fmt.Errorf("failed to add file '%s': %w", fileInfo.SourcePath, err)
+				if ctxErr := cmd.Context().Err(); ctxErr != nil {
+					return fmt.Errorf("archive creation cancelled: %w", ctxErr)
+				}
+				return err
 			}
-
-			if !added {
-				fmt.Printf("Warning: File '%s' skipped (would exceed size limit)\n", fileInfo.SourcePath)
-				break
+			if filesAdded < len(filesToArchive) {
+				return fmt.Errorf("file '%s' would exceed the %d GB size limit after %d of %d files; use --multi-volume to split the archive",
+					filesToArchive[filesAdded].SourcePath, maxSizeGB, filesAdded, len(filesToArchive))
 			}
+		} else {
+			for _, fileInfo := range filesToArchive {
+				if err := cmd.Context().Err(); err != nil {
+					return fmt.Errorf("archive creation cancelled: %w", err)
+				}
 
-			filesAdded++
-		}
+				if verbose {
+					fmt.Printf("Adding: %s -> %s\n", fileInfo.SourcePath, fileInfo.ArchivePath)
+				}
+
+				var added bool
+				if compress {
+					added, err = serializer.AddFileCompressedFromPath(fileInfo.ArchivePath, fileInfo.SourcePath)
+				} else {
+					added, err = serializer.AddFileFromPathContext(cmd.Context(), fileInfo.ArchivePath, fileInfo.SourcePath)
+				}
+				if err != nil {
+					return fmt.Errorf("failed to add file '%s': %w", fileInfo.SourcePath, err)
+				}
 
-		if filesAdded == 0 {
-			return fmt.Errorf("no files were added to the archive")
+				if !added {
+					return fmt.Errorf("file '%s' would exceed the %d GB size limit after %d of %d files; use --multi-volume to split the archive",
+						fileInfo.SourcePath, maxSizeGB, filesAdded, len(filesToArchive))
+				}
+
+				filesAdded++
+			}
 		}
+		meter.finish()
 
 		// Finalize archive
 		finalPath, err := serializer.Finalize()
 		if err != nil {
 			return fmt.Errorf("failed to finalize archive: %w", err)
 		}
+		if force {
+			if err := removeStaleVolumes(outputPath, []string{finalPath}); err != nil {
+				return err
+			}
+		}
 
 		fmt.Printf("Successfully created CAF archive: %s\n", finalPath)
 		fmt.Printf("Files added: %d/%d\n", filesAdded, len(filesToArchive))
@@ -341,6 +502,197 @@ Directories are scanned one level deep for files.`,
 	},
 }
 
+var mergeCmd = &cobra.Command{
+	Use:   "merge <output-file> <caf-files...>",
+	Short: "Merge several CAF archives into one",
+	Long: `Combines the files of the given CAF archives into a single new archive.
+Stored bytes are copied as-is, so checksums and compression are kept.
+A file path present in more than one input is an error unless --last-wins is set.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		outputPath := args[0]
+		inputs := args[1:]
+
+		maxSizeGB, _ := cmd.Flags().GetInt("max-size")
+		lastWins, _ := cmd.Flags().GetBool("last-wins")
+		force, _ := cmd.Flags().GetBool("force")
+
+		// Refuse to clobber an existing archive (or volume set) unless forced
+		if existing, err := caf.FindVolumes(outputPath); err == nil && !force {
+			return fmt.Errorf("output '%s' already exists, use --force to overwrite it", existing[0])
+		}
+
+		for _, input := range inputs {
+			if _, err := os.Stat(input); os.IsNotExist(err) {
+				return fmt.Errorf("CAF file does not exist: %s", input)
+			}
+		}
+
+		legacy, _ := cmd.Flags().GetBool("legacy")
+		utils := &caf.CAFUtils{AllowLegacy: legacy}
+		opts := caf.MergeOptions{MaxChunkSizeGB: maxSizeGB, LastWins: lastWins}
+		if err := utils.MergeWithOptions(outputPath, inputs, opts); err != nil {
+			return fmt.Errorf("failed to merge archives: %w", err)
+		}
+
+		stats, err := utils.GetArchiveStats(outputPath)
+		if err != nil {
+			return fmt.Errorf("failed to read merged archive: %w", err)
+		}
+
+		fmt.Printf("Successfully merged %d archives into %s\n", len(inputs), outputPath)
+		fmt.Printf("Files: %d\n", stats.TotalFiles)
+		return nil
+	},
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export <caf-file> <output-file>",
+	Short: "Convert a CAF archive into a tar or zip file",
+	Long: `Writes every file of the CAF archive into a standard tar or zip file, keeping
+archive paths and any recorded permissions and modification times.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cafFile := args[0]
+		outputPath := args[1]
+
+		// Check if file exists
+		if _, err := os.Stat(cafFile); os.IsNotExist(err) {
+			return fmt.Errorf("CAF file does not exist: %s", cafFile)
+		}
+
+		format, _ := cmd.Flags().GetString("format")
+		force, _ := cmd.Flags().GetBool("force")
+
+		if _, err := os.Stat(outputPath); err == nil && !force {
+			return fmt.Errorf("output '%s' already exists, use --force to overwrite it", outputPath)
+		}
+
+		legacy, _ := cmd.Flags().GetBool("legacy")
+		utils := &caf.CAFUtils{AllowLegacy: legacy}
+
+		var err error
+		switch format {
+		case "tar":
+			err = utils.ExportTar(cafFile, outputPath)
+		case "zip":
+			err = utils.ExportZip(cafFile, outputPath)
+		default:
+			return fmt.Errorf("unsupported export format '%s' (expected tar or zip)", format)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to export archive: %w", err)
+		}
+
+		fmt.Printf("Successfully exported %s to %s (%s)\n", cafFile, outputPath, format)
+		return nil
+	},
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff <old-caf-file> <new-caf-file>",
+	Short: "Show which files differ between two CAF archives",
+	Long: `Compares the indexes of two CAF archives and lists the files that were added,
+removed or modified in the second one. Files are compared by checksum, or by size
+when no comparable checksums exist. With --json, the result is printed as JSON.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, cafFile := range args {
+			if _, err := os.Stat(cafFile); os.IsNotExist(err) {
+				return fmt.Errorf("CAF file does not exist: %s", cafFile)
+			}
+		}
+
+		legacy, _ := cmd.Flags().GetBool("legacy")
+		utils := &caf.CAFUtils{AllowLegacy: legacy}
+		result, err := utils.Diff(args[0], args[1])
+		if err != nil {
+			return fmt.Errorf("failed to diff archives: %w", err)
+		}
+
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		if jsonOutput {
+			return printJSON(result)
+		}
+
+		if len(result.Added)+len(result.Removed)+len(result.Modified) == 0 {
+			fmt.Printf("No differences between %s and %s\n", args[0], args[1])
+		}
+		printDiffSection("Added", "+", result.Added)
+		printDiffSection("Removed", "-", result.Removed)
+		printDiffSection("Modified", "~", result.Modified)
+		if len(result.Unverified) > 0 {
+			fmt.Printf("\n%d files have equal sizes but no comparable checksums, so they may still differ:\n", len(result.Unverified))
+			for _, filePath := range result.Unverified {
+				fmt.Printf("  ? %s\n", filePath)
+			}
+		}
+
+		return nil
+	},
+}
+
+var renameCmd = &cobra.Command{
+	Use:   "rename <caf-file> <old-path> <new-path>",
+	Short: "Rename files inside a CAF archive",
+	Long: `Changes the archive path of a file without touching its data; only the index is rewritten.
+With --prefix, every file whose path starts with <old-path> has that prefix replaced by <new-path>.`,
+	Args: cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cafFile := args[0]
+		oldPath := args[1]
+		newPath := args[2]
+
+		// Check if file exists
+		if _, err := os.Stat(cafFile); os.IsNotExist(err) {
+			return fmt.Errorf("CAF file does not exist: %s", cafFile)
+		}
+
+		legacy, _ := cmd.Flags().GetBool("legacy")
+		prefix, _ := cmd.Flags().GetBool("prefix")
+
+		renames := map[string]string{oldPath: newPath}
+		if prefix {
+			deserializer := caf.NewCAFDeserializer(cafFile)
+			deserializer.SetAllowLegacy(legacy)
+			defer func() { _ = deserializer.Close() }()
+			if err := deserializer.LoadIndex(); err != nil {
+				return fmt.Errorf("failed to load CAF index: %w", err)
+			}
+
+			files, err := deserializer.GetFileList()
+			if err != nil {
+				return fmt.Errorf("failed to get file list: %w", err)
+			}
+
+			renames = make(map[string]string)
+			for _, filePath := range files {
+				if strings.HasPrefix(filePath, oldPath) {
+					renames[filePath] = newPath + strings.TrimPrefix(filePath, oldPath)
+				}
+			}
+			if len(renames) == 0 {
+				return fmt.Errorf("no files in %s start with '%s'", cafFile, oldPath)
+			}
+			if err := deserializer.Close(); err != nil {
+				return fmt.Errorf("failed to close archive: %w", err)
+			}
+		}
+
+		utils := &caf.CAFUtils{AllowLegacy: legacy}
+		err := utils.Rename(cafFile, renames)
+		if errors.Is(err, caf.ErrFileNotFound) {
+			return fmt.Errorf("file '%s' not found in archive", oldPath)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to rename: %w", err)
+		}
+
+		fmt.Printf("Renamed %d files in %s\n", len(renames), cafFile)
+		return nil
+	},
+}
+
 var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Show version information",
@@ -361,21 +713,241 @@ func init() {
 	rootCmd.AddCommand(extractCmd)
 	rootCmd.AddCommand(validateCmd)
 	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(mergeCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(renameCmd)
 	rootCmd.AddCommand(versionCmd)
 
 	// Add flags
+	rootCmd.PersistentFlags().Bool("legacy", false, "Accept archives written without the CAF magic header")
 	createCmd.Flags().IntP("max-size", "s", 30, "Maximum archive size in GB")
 	createCmd.Flags().BoolP("verbose", "v", false, "Show detailed progress information")
 	createCmd.Flags().StringP("base-dir", "b", "", "Base directory for relative paths (default: current directory)")
+	createCmd.Flags().BoolP("recursive", "r", false, "Scan directories recursively (symlinks are not followed)")
+	createCmd.Flags().BoolP("compress", "z", false, "Gzip each file before storing it (poorly compressible files are stored raw)")
+	createCmd.Flags().BoolP("multi-volume", "m", false, "Roll over to numbered volumes (<output-file>.001, .002, ...) when the size limit is reached")
+	createCmd.Flags().Bool("dedup", false, "Store identical files only once")
+	createCmd.Flags().BoolP("force", "f", false, "Overwrite the output file if it already exists")
+	createCmd.Flags().Bool("progress", false, "Show a progress meter on stderr")
+	createCmd.Flags().IntP("jobs", "j", 1, "Number of files to read and checksum concurrently")
+	createCmd.Flags().Bool("plain-index", false, "Store the index as plain JSON so older CAF readers (including the TypeScript worker) can read the archive")
+	createCmd.Flags().Bool("header-index", false, "Record the index location in the header so readers can find it with one read (not readable by older CAF readers)")
 
 	splitCmd.Flags().StringP("output", "o", "", "Output directory for extracted files (default: extracted_files)")
+	splitCmd.Flags().IntP("jobs", "j", 1, "Number of files to extract concurrently")
+	splitCmd.Flags().Bool("progress", false, "Show a progress meter on stderr")
+	splitCmd.Flags().String("filter", "", "Only extract files matching a glob (e.g. 'docs/*.txt') or path prefix (e.g. 'images/')")
+	mergeCmd.Flags().IntP("max-size", "s", 30, "Maximum size of the merged archive in GB")
+	mergeCmd.Flags().Bool("last-wins", false, "On duplicate file paths keep the copy from the last input instead of failing")
+	mergeCmd.Flags().BoolP("force", "f", false, "Overwrite the output file if it already exists")
+	exportCmd.Flags().String("format", "tar", "Output format: tar or zip")
+	exportCmd.Flags().BoolP("force", "f", false, "Overwrite the output file if it already exists")
+	diffCmd.Flags().Bool("json", false, "Print the differences as JSON")
+	renameCmd.Flags().Bool("prefix", false, "Treat <old-path> and <new-path> as path prefixes and rename every matching file")
 	statsCmd.Flags().BoolP("verbose", "v", false, "Show detailed file information")
+	statsCmd.Flags().Bool("json", false, "Print statistics as JSON")
+	listCmd.Flags().Bool("json", false, "Print the file list as JSON")
+	validateCmd.Flags().BoolP("checksums", "c", false, "Verify the checksum of every file in the archive")
+	validateCmd.Flags().Bool("deep", false, "Cross-check every index entry's byte range against the archive layout")
+}
+
+// createVolumes writes the files into a multi-volume archive, starting a new
+// volume whenever the size limit is reached
+func createVolumes(ctx context.Context, outputPath string, filesToArchive []caf.FileToArchive, maxSizeGB int, compress, dedup, plainIndex, headerIndex, force, verbose bool, meter *progressMeter) error {
+	serializer, err := caf.NewCAFVolumeSerializer(outputPath, maxSizeGB)
+	if err != nil {
+		return fmt.Errorf("failed to create serializer: %w", err)
+	}
+	defer func() { _ = serializer.Cleanup() }()
+
+	serializer.SetDeduplicate(dedup)
+	if plainIndex {
+		if err := serializer.SetCompressIndex(false); err != nil {
+			return err
+		}
+	}
+	if headerIndex {
+		if err := serializer.SetHeaderIndexOffset(true); err != nil {
+			return err
+		}
+	}
+	if verbose {
+		serializer.SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}
+	if meter != nil {
+		serializer.SetProgress(meter.update)
+	}
+
+	for _, fileInfo := range filesToArchive {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("archive creation cancelled: %w", err)
+		}
+
+		if verbose {
+			fmt.Printf("Adding: %s -> %s\n", fileInfo.SourcePath, fileInfo.ArchivePath)
+		}
+
+		if compress {
+			err = serializer.AddFileCompressedFromPath(fileInfo.ArchivePath, fileInfo.SourcePath)
+		} else {
+			err = serializer.AddFileFromPath(fileInfo.ArchivePath, fileInfo.SourcePath)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add file '%s': %w", fileInfo.SourcePath, err)
+		}
+	}
+	meter.finish()
+
+	volumes, err := serializer.Finalize()
+	if err != nil {
+		return fmt.Errorf("failed to finalize archive: %w", err)
+	}
+	if force {
+		if err := removeStaleVolumes(outputPath, volumes); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Successfully created CAF archive in %d volume(s):\n", len(volumes))
+	for _, volume := range volumes {
+		fmt.Printf("  %s\n", volume)
+	}
+	fmt.Printf("Files added: %d/%d\n", len(filesToArchive), len(filesToArchive))
+
+	return nil
+}
+
+// removeStaleVolumes deletes what is left of an earlier archive at outputPath
+// once the new one, made of the files in keep, has been written: the single-file
+// archive and any numbered volumes, which would otherwise be read back alongside,
+// or instead of, the new archive.
+func removeStaleVolumes(outputPath string, keep []string) error {
+	paths, err := filepath.Glob(outputPath + ".[0-9][0-9][0-9]")
+	if err != nil {
+		return fmt.Errorf("failed to search for old volumes: %w", err)
+	}
+	paths = append(paths, outputPath)
+
+	for _, path := range paths {
+		if slices.Contains(keep, path) {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove '%s': %w", path, err)
+		}
+	}
+	return nil
+}
+
+// progressMeter draws a single-line progress display on stderr. It is safe for
+// concurrent use, and a nil meter does nothing.
+type progressMeter struct {
+	mu          sync.Mutex
+	totalFiles  int
+	completed   int
+	lastPath    string
+	lastPercent int64
+	finished    bool
+}
+
+// newProgressMeter creates a meter for the given number of files
+func newProgressMeter(totalFiles int) *progressMeter {
+	return &progressMeter{totalFiles: totalFiles}
+}
+
+// update is a caf.ProgressFunc that redraws the meter whenever the displayed values change
+func (m *progressMeter) update(filePath string, bytesDone, bytesTotal int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	percent := int64(100)
+	if bytesTotal > 0 {
+		percent = bytesDone * 100 / bytesTotal
+	}
+	if bytesDone == bytesTotal {
+		m.completed++
+	}
+	if filePath == m.lastPath && percent == m.lastPercent && bytesDone != bytesTotal {
+		return
+	}
+
+	m.lastPath, m.lastPercent = filePath, percent
+	fmt.Fprintf(os.Stderr, "\r\033[K[%d/%d] %3d%% %s", m.completed, m.totalFiles, percent, filePath)
+}
+
+// finish ends the meter's line; calling it again has no effect
+func (m *progressMeter) finish() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.finished {
+		m.finished = true
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// printDiffSection prints one category of a diff, skipping empty ones
+func printDiffSection(title, marker string, paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	fmt.Printf("%s (%d):\n", title, len(paths))
+	for _, filePath := range paths {
+		fmt.Printf("  %s %s\n", marker, filePath)
+	}
+}
+
+// openArchive loads the index of the archive at cafFile, which may be the base
+// name of a multi-volume archive
+func openArchive(cmd *cobra.Command, cafFile string) (*caf.CAFVolumeSet, error) {
+	volumes, err := caf.FindVolumes(cafFile)
+	if err != nil {
+		return nil, err
+	}
+
+	legacy, _ := cmd.Flags().GetBool("legacy")
+	archive := caf.NewCAFVolumeSet(volumes)
+	archive.SetAllowLegacy(legacy)
+	if err := archive.LoadIndex(); err != nil {
+		_ = archive.Close()
+		return nil, fmt.Errorf("failed to load CAF index: %w", err)
+	}
+	return archive, nil
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("failed to encode JSON output: %w", err)
+	}
+	return nil
 }
 
 // collectFiles gathers all files to be archived from the input paths
-func collectFiles(inputPaths []string, baseDir string, verbose bool) ([]FileToArchive, error) {
-	var files []FileToArchive
-	seen := make(map[string]bool) // Prevent duplicate files
+func collectFiles(inputPaths []string, baseDir string, recursive, verbose bool) ([]caf.FileToArchive, error) {
+	var files []caf.FileToArchive
+	seen := make(map[string]bool)      // Prevent duplicate files
+	sources := make(map[string]string) // Archive path -> source path, to catch collisions
+
+	addFile := func(file caf.FileToArchive) error {
+		if seen[file.SourcePath] {
+			return nil
+		}
+		if other, exists := sources[file.ArchivePath]; exists {
+			return fmt.Errorf("files '%s' and '%s' would both be stored as '%s' (use --base-dir to keep their paths apart)",
+				other, file.SourcePath, file.ArchivePath)
+		}
+		files = append(files, file)
+		seen[file.SourcePath] = true
+		sources[file.ArchivePath] = file.SourcePath
+		return nil
+	}
 
 	// Use current directory as base if not specified
 	if baseDir == "" {
@@ -392,6 +964,12 @@ func collectFiles(inputPaths []string, baseDir string, verbose bool) ([]FileToAr
 		return nil, fmt.Errorf("failed to resolve base directory: %w", err)
 	}
 
+	// Replace glob patterns with the paths they match
+	inputPaths, err = expandPatterns(inputPaths, verbose)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, inputPath := range inputPaths {
 		// Make input path absolute
 		absPath, err := filepath.Abs(inputPath)
@@ -406,17 +984,21 @@ func collectFiles(inputPaths []string, baseDir string, verbose bool) ([]FileToAr
 		}
 
 		if info.IsDir() {
-			// Scan directory (one level deep only)
-			dirFiles, err := collectFromDirectory(absPath, baseDir, verbose)
+			// Scan directory (one level deep unless recursive)
+			var dirFiles []caf.FileToArchive
+			if recursive {
+				dirFiles, err = collectFromDirectoryRecursive(absPath, baseDir, verbose)
+			} else {
+				dirFiles, err = collectFromDirectory(absPath, baseDir, verbose)
+			}
 			if err != nil {
 				return nil, fmt.Errorf("failed to scan directory '%s': %w", inputPath, err)
 			}
 
 			// Add files, avoiding duplicates
 			for _, file := range dirFiles {
-				if !seen[file.SourcePath] {
-					files = append(files, file)
-					seen[file.SourcePath] = true
+				if err := addFile(file); err != nil {
+					return nil, err
 				}
 			}
 		} else {
@@ -426,12 +1008,8 @@ func collectFiles(inputPaths []string, baseDir string, verbose bool) ([]FileToAr
 				return nil, fmt.Errorf("failed to determine archive path for '%s': %w", inputPath, err)
 			}
 
-			if !seen[absPath] {
-				files = append(files, FileToArchive{
-					SourcePath:  absPath,
-					ArchivePath: archivePath,
-				})
-				seen[absPath] = true
+			if err := addFile(caf.FileToArchive{SourcePath: absPath, ArchivePath: archivePath}); err != nil {
+				return nil, err
 			}
 		}
 	}
@@ -439,9 +1017,125 @@ func collectFiles(inputPaths []string, baseDir string, verbose bool) ([]FileToAr
 	return files, nil
 }
 
+// expandPatterns replaces every input containing glob metacharacters with the
+// paths it matches, so quoted patterns work even where the shell would not
+// expand them. Literal paths are passed through unchanged, including existing
+// files whose names happen to contain metacharacters.
+func expandPatterns(inputPaths []string, verbose bool) ([]string, error) {
+	expanded := make([]string, 0, len(inputPaths))
+	for _, inputPath := range inputPaths {
+		if !strings.ContainsAny(inputPath, "*?[") {
+			expanded = append(expanded, inputPath)
+			continue
+		}
+		if _, err := os.Lstat(inputPath); err == nil {
+			expanded = append(expanded, inputPath)
+			continue
+		}
+
+		var (
+			matches []string
+			err     error
+		)
+		if strings.Contains(inputPath, "**") {
+			matches, err = globRecursive(inputPath)
+		} else {
+			matches, err = filepath.Glob(inputPath)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %w", inputPath, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files matched pattern '%s'", inputPath)
+		}
+
+		if verbose {
+			fmt.Printf("Pattern %s matched %d paths\n", inputPath, len(matches))
+		}
+		expanded = append(expanded, matches...)
+	}
+	return expanded, nil
+}
+
+// globRecursive expands a pattern in which a "**" component matches any number
+// of directories, e.g. 'src/**/*.go'. The tree below the pattern's literal
+// leading directories is walked without following symlinks.
+func globRecursive(pattern string) ([]string, error) {
+	parts := strings.Split(filepath.Clean(pattern), string(filepath.Separator))
+
+	// Walk from the deepest directory that needs no matching
+	rootParts := 0
+	for rootParts < len(parts) && !strings.ContainsAny(parts[rootParts], "*?[") {
+		rootParts++
+	}
+	root := strings.Join(parts[:rootParts], string(filepath.Separator))
+	switch {
+	case root == "" && filepath.IsAbs(pattern):
+		root = string(filepath.Separator)
+	case root == "":
+		root = "."
+	}
+
+	// Reject malformed components up front, as filepath.Glob does
+	for _, part := range parts[rootParts:] {
+		if _, err := filepath.Match(part, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	var matches []string
+	err := filepath.WalkDir(root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filePath == root {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if filePath == root || entry.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		if matchComponents(parts[rootParts:], strings.Split(relPath, string(filepath.Separator))) {
+			matches = append(matches, filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// matchComponents reports whether the path components match the pattern
+// components, where a "**" component matches zero or more path components
+func matchComponents(pattern, components []string) bool {
+	if len(pattern) == 0 {
+		return len(components) == 0
+	}
+
+	if pattern[0] == "**" {
+		for skip := 0; skip <= len(components); skip++ {
+			if matchComponents(pattern[1:], components[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(components) == 0 {
+		return false
+	}
+	matched, err := filepath.Match(pattern[0], components[0])
+	return err == nil && matched && matchComponents(pattern[1:], components[1:])
+}
+
 // collectFromDirectory scans a directory one level deep for files
-func collectFromDirectory(dirPath, baseDir string, verbose bool) ([]FileToArchive, error) {
-	var files []FileToArchive
+func collectFromDirectory(dirPath, baseDir string, verbose bool) ([]caf.FileToArchive, error) {
+	var files []caf.FileToArchive
 
 	if verbose {
 		fmt.Printf("Scanning directory: %s\n", dirPath)
@@ -468,7 +1162,7 @@ func collectFromDirectory(dirPath, baseDir string, verbose bool) ([]FileToArchiv
 			return nil, fmt.Errorf("failed to determine archive path for '%s': %w", filePath, err)
 		}
 
-		files = append(files, FileToArchive{
+		files = append(files, caf.FileToArchive{
 			SourcePath:  filePath,
 			ArchivePath: archivePath,
 		})
@@ -481,6 +1175,52 @@ func collectFromDirectory(dirPath, baseDir string, verbose bool) ([]FileToArchiv
 	return files, nil
 }
 
+// collectFromDirectoryRecursive walks a directory tree for files without following symlinks
+func collectFromDirectoryRecursive(dirPath, baseDir string, verbose bool) ([]caf.FileToArchive, error) {
+	var files []caf.FileToArchive
+
+	err := filepath.WalkDir(dirPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if verbose {
+				fmt.Printf("Scanning directory: %s\n", filePath)
+			}
+			return nil
+		}
+
+		if entry.Type()&fs.ModeSymlink != 0 {
+			// Skip symlinks to avoid cycles and escaping the tree
+			if verbose {
+				fmt.Printf("Skipping symlink: %s\n", filePath)
+			}
+			return nil
+		}
+
+		archivePath, err := getArchivePath(filePath, baseDir)
+		if err != nil {
+			return fmt.Errorf("failed to determine archive path for '%s': %w", filePath, err)
+		}
+
+		files = append(files, caf.FileToArchive{
+			SourcePath:  filePath,
+			ArchivePath: archivePath,
+		})
+
+		if verbose {
+			fmt.Printf("Found file: %s -> %s\n", filePath, archivePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk directory: %w", err)
+	}
+
+	return files, nil
+}
+
 // getArchivePath determines the path to use for a file within the archive
 func getArchivePath(filePath, baseDir string) (string, error) {
 	// Try to make the path relative to baseDir
@@ -500,7 +1240,12 @@ func getArchivePath(filePath, baseDir string) (string, error) {
 }
 
 func main() {
-	if err := rootCmd.Execute(); err != nil {
+	// Cancel long-running commands gracefully on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
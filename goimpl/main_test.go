@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	caf "cafcli/impl"
+)
+
+// runCreate runs the create command with args, resetting the flags these tests
+// use first so runs within one test binary do not leak into each other
+func runCreate(t *testing.T, args ...string) error {
+	t.Helper()
+	for _, name := range []string{"force", "multi-volume", "max-size", "base-dir"} {
+		flag := createCmd.Flags().Lookup(name)
+		_ = flag.Value.Set(flag.DefValue)
+		flag.Changed = false
+	}
+	rootCmd.SetOut(io.Discard)
+	rootCmd.SetErr(io.Discard)
+	rootCmd.SetArgs(append([]string{"create"}, args...))
+	return rootCmd.Execute()
+}
+
+// writeSourceFiles creates a small file and a sparse one just over 1 GB, which
+// cannot fit in any volume of a --max-size 1 archive
+func writeSourceFiles(t *testing.T, dir string) (small, large string) {
+	t.Helper()
+	small = filepath.Join(dir, "a-small.txt")
+	if err := os.WriteFile(small, []byte("new content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	large = filepath.Join(dir, "b-large.bin")
+	if err := os.WriteFile(large, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(large, 1024*1024*1024+1); err != nil {
+		t.Fatal(err)
+	}
+	return small, large
+}
+
+// TestForcedCreateFailureKeepsOldArchive checks that a forced multi-volume run
+// that fails leaves the archive it was meant to replace in place
+func TestForcedCreateFailureKeepsOldArchive(t *testing.T) {
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "out.caf")
+	small, large := writeSourceFiles(t, t.TempDir())
+
+	oldSource := filepath.Join(t.TempDir(), "old.txt")
+	if err := os.WriteFile(oldSource, []byte("old content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCreate(t, outputPath, oldSource); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runCreate(t, "--force", "-m", "-s", "1", "-b", filepath.Dir(small), outputPath, small, large); err == nil {
+		t.Fatal("expected the oversized file to fail the run")
+	}
+
+	after, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("old archive is gone: %v", err)
+	}
+	if !bytes.Equal(after, before) {
+		t.Fatal("old archive was modified by the failed run")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the old archive to remain, found %d files", len(entries))
+	}
+}
+
+// TestForcedCreateRemovesStaleVolumes checks that once a forced run succeeds,
+// volumes of the earlier archive that were not rewritten are gone
+func TestForcedCreateRemovesStaleVolumes(t *testing.T) {
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "out.caf")
+	small, _ := writeSourceFiles(t, t.TempDir())
+
+	for _, path := range []string{outputPath + ".001", outputPath + ".002"} {
+		if err := os.WriteFile(path, []byte("stale volume"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := runCreate(t, "--force", "-m", "-b", filepath.Dir(small), outputPath, small); err != nil {
+		t.Fatal(err)
+	}
+
+	volumes, err := caf.FindVolumes(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 || volumes[0] != outputPath {
+		t.Fatalf("expected only '%s', found %v", outputPath, volumes)
+	}
+	set := caf.NewCAFVolumeSet(volumes)
+	defer func() { _ = set.Close() }()
+	if err := set.LoadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := set.ExtractFile("a-small.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new content" {
+		t.Errorf("extracted %q", data)
+	}
+}
@@ -10,6 +10,11 @@ import * as os from 'os';
  * Based on the CAF specification v1.0
  */
 
+// Header written by newer CAF writers (see FORMAT.md); this serializer writes headerless archives
+const CAF_MAGIC = 'CAF1';
+const CAF_HEADER_SIZE = 5;
+const CAF_HEADER_VERSION_PLAIN_INDEX = 1;
+
 // Type definitions based on FORMAT.md
 export interface CAFFileMetadata {
   start_byte: number;
@@ -429,6 +434,18 @@ export class CAFDeserializer {
     const fileHandle = await fs.promises.open(this.archivePath, 'r');
     
     try {
+      // Archives with a CAF1 header are readable as long as their index is plain JSON
+      // located by the footer (header version 1); offsets are absolute, so the header
+      // itself needs no special handling. Headerless archives start with file data.
+      const headerBuffer = Buffer.alloc(CAF_HEADER_SIZE);
+      await fileHandle.read(headerBuffer, 0, CAF_HEADER_SIZE, 0);
+      if (headerBuffer.toString('ascii', 0, 4) === CAF_MAGIC) {
+        const headerVersion = headerBuffer.readUInt8(4);
+        if (headerVersion !== CAF_HEADER_VERSION_PLAIN_INDEX) {
+          throw new Error(`Unsupported CAF header version ${headerVersion} (only plain JSON indexes can be read; create the archive with --plain-index)`);
+        }
+      }
+
       await fileHandle.read(footerBuffer, 0, 4, this.fileSize - 4);
       const indexSize = footerBuffer.readUInt32LE(0);
 